@@ -8,29 +8,109 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Conf struct {
-	BinLogConf *BinLogConf
-	MySQL      *MySQLConf
-	ES         *ESConf
-	Rule       *Rule
+	BinLogConf     *BinLogConf
+	MySQL          *MySQLConf
+	ES             *ESConf
+	Rule           *Rule
+	DeadLetterConf *DeadLetterConf
+	FullConf       *FullConf
+}
+
+const FullStrategyRange = "range"
+
+const FullStrategyKeyset = "keyset"
+
+type FullConf struct {
+	// 读取方式 range 按ID范围并发读取，keyset 按主键顺序分页读取，适合稀疏的ID
+	Strategy string
+	// 并发读取 MySQL 的协程数，每个协程使用一个独立的快照连接
+	Readers int
+	// 并发写入 ES 的协程数
+	Writers int
+	// 每批读取的ID范围
+	ChunkSize int
+	// 读取完成等待写入的批次上限，用于限制内存占用
+	QueueSize int
+	// keyset 方式每页读取的行数
+	BatchSize int
+}
+
+type DeadLetterConf struct {
+	// 为空时写入同步进度文件所在目录
+	FilePath string
 }
 
 type BinLogConf struct {
 	StartBinLogName      string
 	StartBinLogPosition  int
 	BinLogStatusFilePath string
+	WorkerCount          int
+	// 直接使用 binlog 中的行数据构建主表字段，需要 binlog_format=ROW 与 binlog_row_image=FULL
+	UseRowImage bool
 }
 
 type ESConf struct {
-	Host  string
-	Port  int
-	Index string
-	Type  string
+	Host string
+	Port int
+	// 集群节点地址，未配置时使用 Scheme://Host:Port
+	Nodes []string
+	// 节点选择策略 roundRobin、leastLoaded
+	NodeSelector          string
+	HealthCheckIntervalMs int
+	// 创建索引时使用的 settings
+	Settings map[string]interface{}
+	// 是否使用索引模板（匹配 Index*）保存 settings 与 mappings
+	Template bool
+	// 是否定期通过 _nodes/http 发现集群节点
+	Sniff           bool
+	SniffIntervalMs int
+	Index           string
+	// ES 7 及以上、OpenSearch 不需要配置
+	Type string
+	// 为空时从集群根路径自动识别，可配置为 6、7.10.2、opensearch 等
+	Version string
+	// http 或 https
+	Scheme string
+	// 认证方式，按 ApiKey、BearerToken、Username 的优先级选择其一
+	Username    string
+	Password    string
+	ApiKey      string
+	BearerToken string
+	// https 时使用的 CA 证书、客户端证书
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	// 可重试错误（网络错误、429、502、503、504）的重试策略
+	RetryMaxAttempts      int
+	RetryInitialBackoffMs int
+	RetryMaxBackoffMs     int
+	// 连续失败达到阈值后熔断，熔断期间所有请求阻塞等待
+	BreakerThreshold int
+	BreakerOpenMs    int
+	// 重试耗尽后是否一直阻塞直到ES恢复，而不是丢弃数据
+	BlockOnFailure bool
+	// 单个请求的超时时间，节点无响应时按网络错误重试
+	RequestTimeoutMs int
+	// 增量同步时 bulk 缓冲的刷新条件，任一满足即刷新
+	BulkMaxActions      int
+	BulkMaxBytes        int
+	BulkFlushIntervalMs int
+	// 值为 NULL 的字段不写入文档，默认写入 null
+	OmitNull bool
 }
 
+const DecimalString = "string"
+
+const DecimalNumber = "number"
+
 type MySQLConf struct {
 	Host              string
 	Port              int
@@ -42,6 +122,10 @@ type MySQLConf struct {
 	HeartbeatPeriodMs int
 	ServerID          uint32
 	Database          string
+	// DECIMAL 写入ES的方式 string 保留精度、number 写为数字
+	DecimalEncoding string
+	// DATETIME 列所在的时区（如 Asia/Shanghai），为空时不带时区写入，ES 按 UTC 解析
+	DatetimeZone string
 }
 
 type Coll struct {
@@ -49,19 +133,47 @@ type Coll struct {
 	CollType    uint8
 	MappingName string
 	FullName    string
+	// ES 字段类型与分词器，未配置时根据 CollType 推导
+	EsType   string
+	Analyzer string
+	// EsType 是否为配置的类型，推导的类型只用于创建索引，不与已有索引的 mapping 比较
+	ExplicitType bool
 }
 
 type JoinTable struct {
 	TableName    string
 	CollList     map[string]*Coll
 	JoinCollName string
+	// 连接到上级表的字段，上级表为 ParentName，为空时上级表为主表
 	MainCollName string
+	ParentName   string
+	// 一对多连接，附表的多行聚合为主表文档中名为 ArrayName 的对象数组，ArrayType 为 nested 或 object
+	Many      bool
+	ArrayName string
+	ArrayType string
+	// 对象数组在文档中对应的字段，值为 []map[string]interface{}
+	ArrayColl *Coll
 }
 
 type MainTable struct {
-	TableName    string
-	CollList     map[string]*Coll
-	MainCollName string
+	TableName string
+	CollList  map[string]*Coll
+	// 主键字段，联合主键时按配置顺序排列
+	KeyCollNames []string
+	// 文档ID模板，如 {tenant_id}_{id}，单一主键时为空，直接使用主键值作为文档ID
+	DocIdTemplate string
+}
+
+// DocId 根据主键值（按 KeyCollNames 顺序）生成ES文档ID
+func (t *MainTable) DocId(key []interface{}) interface{} {
+	if t.DocIdTemplate == "" {
+		return key[0]
+	}
+	id := t.DocIdTemplate
+	for i, name := range t.KeyCollNames {
+		id = strings.Replace(id, "{"+name+"}", fmt.Sprintf("%v", key[i]), -1)
+	}
+	return id
 }
 
 type Rule struct {
@@ -69,6 +181,55 @@ type Rule struct {
 	MainTable  *MainTable
 }
 
+// ParentTableName 返回附表连接的上级表名
+func (r *Rule) ParentTableName(t *JoinTable) string {
+	if t.ParentName == "" {
+		return r.MainTable.TableName
+	}
+	return t.ParentName
+}
+
+// Children 返回直接连接在 parentName 下的附表，parentName 为空时返回直接连接主表的附表
+func (r *Rule) Children(parentName string) []*JoinTable {
+	var children []*JoinTable
+	for _, t := range r.JoinTables {
+		if t.ParentName == parentName {
+			children = append(children, t)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].TableName < children[j].TableName })
+	return children
+}
+
+// Subtree 按层级顺序返回以 t 为根的所有附表（包括 t），上级表总是排在下级表之前，可以直接生成 LEFT JOIN
+// t 为 nil 时返回全部附表
+func (r *Rule) Subtree(t *JoinTable) []*JoinTable {
+	var queue []*JoinTable
+	if t == nil {
+		queue = r.Children("")
+	} else {
+		queue = []*JoinTable{t}
+	}
+	var tables []*JoinTable
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		tables = append(tables, table)
+		queue = append(queue, r.Children(table.TableName)...)
+	}
+	return tables
+}
+
+// Ancestors 返回 t 的所有上级附表，由近到远，不包括主表
+func (r *Rule) Ancestors(t *JoinTable) []*JoinTable {
+	var tables []*JoinTable
+	for t.ParentName != "" {
+		t = r.JoinTables[t.ParentName]
+		tables = append(tables, t)
+	}
+	return tables
+}
+
 func getOrError(m map[interface{}]interface{}, key interface{}, msg string, check func(v interface{}) bool) interface{} {
 	v, e := m[key]
 	if e && check(v) {
@@ -114,6 +275,10 @@ func Load(confPath *string) *Conf {
 	conf.initRule(m["rule"].(map[interface{}]interface{}))
 	conf.initESConf(m["es"].(map[interface{}]interface{}))
 	conf.initBinLogConf(m["binlog"].(map[interface{}]interface{}))
+	deadLetter, _ := m["deadLetter"].(map[interface{}]interface{})
+	conf.initDeadLetterConf(deadLetter)
+	full, _ := m["full"].(map[interface{}]interface{})
+	conf.initFullConf(full)
 	return conf
 }
 
@@ -123,12 +288,33 @@ func (c *Conf) initBinLogConf(m map[interface{}]interface{}) {
 	binLogConf.StartBinLogPosition = getOrDefault(m, "startBinLogPosition", 0, NotCheck).(int)
 	binLogConf.BinLogStatusFilePath = getOrError(m, "binLogStatusFilePath", "[binlog.binLogStatusFilePath] 不存在，请填写一个文件位置用来存储同步进度",
 		func(v interface{}) bool { return v != "" }).(string)
+	binLogConf.WorkerCount = getOrDefault(m, "workerCount", 4, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	binLogConf.UseRowImage = getOrDefault(m, "useRowImage", false, NotCheck).(bool)
 	if !utils.IsDir(binLogConf.BinLogStatusFilePath) {
 		log.Panicf("同步进度文件 %v 路径错误，请检查", binLogConf.BinLogStatusFilePath)
 	}
 	c.BinLogConf = binLogConf
 }
 
+func (c *Conf) initDeadLetterConf(m map[interface{}]interface{}) {
+	deadLetterConf := &DeadLetterConf{}
+	deadLetterConf.FilePath = getOrDefault(m, "filePath", "", NotCheck).(string)
+	c.DeadLetterConf = deadLetterConf
+}
+
+func (c *Conf) initFullConf(m map[interface{}]interface{}) {
+	fullConf := &FullConf{}
+	fullConf.Strategy = getOrDefault(m, "strategy", FullStrategyRange, func(v interface{}) bool {
+		return v == FullStrategyRange || v == FullStrategyKeyset
+	}).(string)
+	fullConf.Readers = getOrDefault(m, "readers", 1, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	fullConf.Writers = getOrDefault(m, "writers", 1, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	fullConf.ChunkSize = getOrDefault(m, "chunkSize", 1000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	fullConf.QueueSize = getOrDefault(m, "queueSize", fullConf.Writers*2, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	fullConf.BatchSize = getOrDefault(m, "batchSize", 1000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	c.FullConf = fullConf
+}
+
 func (c *Conf) initMySQLConf(m map[interface{}]interface{}) {
 	mySQLConf := &MySQLConf{}
 	mySQLConf.Host = getOrError(m, "host", "[mysql.host] 不存在", func(v interface{}) bool { return v != "" }).(string)
@@ -141,18 +327,116 @@ func (c *Conf) initMySQLConf(m map[interface{}]interface{}) {
 	mySQLConf.HeartbeatPeriodMs = getOrDefault(m, "heartbeatPeriod", 90000, func(v interface{}) bool { return v != 0 }).(int)
 	mySQLConf.ServerID = uint32(rand.New(rand.NewSource(time.Now().Unix())).Intn(1000)) + 1001
 	mySQLConf.Database = getOrError(m, "database", "[mysql.database] 不存在", func(v interface{}) bool { return v != "" }).(string)
+	mySQLConf.DecimalEncoding = getOrDefault(m, "decimalEncoding", DecimalString, func(v interface{}) bool {
+		return v == DecimalString || v == DecimalNumber
+	}).(string)
+	mySQLConf.DatetimeZone = getOrDefault(m, "datetimeZone", "", NotCheck).(string)
 	c.MySQL = mySQLConf
 }
 
 func (c *Conf) initESConf(m map[interface{}]interface{}) {
 	esConf := &ESConf{}
-	esConf.Host = getOrError(m, "host", "[es.host] 不存在", func(v interface{}) bool { return v != "" }).(string)
-	esConf.Port = getOrError(m, "port", "[es.port] 不存在", func(v interface{}) bool { return v != 0 }).(int)
 	esConf.Index = getOrError(m, "index", "[es.index] 不存在", func(v interface{}) bool { return v != "" }).(string)
-	esConf.Type = getOrError(m, "type", "[es.type] 不存在", func(v interface{}) bool { return v != "" }).(string)
+	esConf.Type = getOrDefault(m, "type", "", NotCheck).(string)
+	// YAML 会把 7.10 解析为浮点数 7.1，只接受字符串与整数的主版本号
+	switch version := getOrDefault(m, "version", "", NotCheck).(type) {
+	case nil:
+	case string:
+		esConf.Version = version
+	case int:
+		esConf.Version = strconv.Itoa(version)
+	default:
+		log.Panicf("[es.version] %v 需要加上引号配置为字符串，如 \"7.10.2\"", version)
+	}
+	esConf.Username = getOrDefault(m, "username", "", NotCheck).(string)
+	esConf.Password = getOrDefault(m, "password", "", NotCheck).(string)
+	esConf.ApiKey = getOrDefault(m, "apiKey", "", NotCheck).(string)
+	esConf.BearerToken = getOrDefault(m, "bearerToken", "", NotCheck).(string)
+	esConf.CaFile = getOrDefault(m, "caFile", "", NotCheck).(string)
+	esConf.CertFile = getOrDefault(m, "certFile", "", NotCheck).(string)
+	esConf.KeyFile = getOrDefault(m, "keyFile", "", NotCheck).(string)
+	esConf.InsecureSkipVerify = getOrDefault(m, "insecureSkipVerify", false, NotCheck).(bool)
+	if (esConf.CertFile == "") != (esConf.KeyFile == "") {
+		log.Panic("[es.certFile] 与 [es.keyFile] 需要同时配置")
+	}
+	nodes := getOrDefault(m, "nodes", []interface{}{}, func(v interface{}) bool { return v != nil }).([]interface{})
+	for _, node := range nodes {
+		esConf.Nodes = append(esConf.Nodes, node.(string))
+	}
+	// 配置了节点列表时协议以节点地址为准，所有节点必须使用同一协议，未写协议的节点使用 scheme
+	esConf.Scheme = getOrDefault(m, "scheme", "", func(v interface{}) bool { return v == "http" || v == "https" }).(string)
+	nodeScheme := ""
+	for _, node := range esConf.Nodes {
+		j := strings.Index(node, "://")
+		if j < 0 {
+			continue
+		}
+		scheme := node[:j]
+		if scheme != "http" && scheme != "https" {
+			log.Panicf("[es.nodes] 节点 %v 的协议只能是 http 或 https", node)
+		}
+		if nodeScheme != "" && scheme != nodeScheme {
+			log.Panicf("[es.nodes] 节点的协议不一致，%v 与 %v", nodeScheme, scheme)
+		}
+		nodeScheme = scheme
+	}
+	if nodeScheme != "" && esConf.Scheme != "" && esConf.Scheme != nodeScheme {
+		log.Panicf("[es.scheme] %v 与节点地址的协议 %v 不一致", esConf.Scheme, nodeScheme)
+	}
+	if esConf.Scheme == "" {
+		esConf.Scheme = nodeScheme
+	}
+	if esConf.Scheme == "" {
+		esConf.Scheme = "http"
+	}
+	for i, node := range esConf.Nodes {
+		if !strings.Contains(node, "://") {
+			esConf.Nodes[i] = esConf.Scheme + "://" + node
+		}
+	}
+	if len(esConf.Nodes) == 0 {
+		esConf.Host = getOrError(m, "host", "[es.host] 不存在", func(v interface{}) bool { return v != "" }).(string)
+		esConf.Port = getOrError(m, "port", "[es.port] 不存在", func(v interface{}) bool { return v != 0 }).(int)
+		esConf.Nodes = []string{fmt.Sprintf("%v://%v:%v", esConf.Scheme, esConf.Host, esConf.Port)}
+	}
+	esConf.NodeSelector = getOrDefault(m, "nodeSelector", "roundRobin", func(v interface{}) bool { return v == "roundRobin" || v == "leastLoaded" }).(string)
+	esConf.HealthCheckIntervalMs = getOrDefault(m, "healthCheckIntervalMs", 10000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	settings := getOrDefault(m, "settings", make(map[interface{}]interface{}), func(v interface{}) bool { return v != nil })
+	esConf.Settings = utils.ToStringMap(settings).(map[string]interface{})
+	esConf.Template = getOrDefault(m, "template", false, NotCheck).(bool)
+	esConf.Sniff = getOrDefault(m, "sniff", false, NotCheck).(bool)
+	esConf.SniffIntervalMs = getOrDefault(m, "sniffIntervalMs", 300000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.RetryMaxAttempts = getOrDefault(m, "retryMaxAttempts", 5, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.RetryInitialBackoffMs = getOrDefault(m, "retryInitialBackoffMs", 100, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.RetryMaxBackoffMs = getOrDefault(m, "retryMaxBackoffMs", 10000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BreakerThreshold = getOrDefault(m, "breakerThreshold", 5, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BreakerOpenMs = getOrDefault(m, "breakerOpenMs", 30000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BlockOnFailure = getOrDefault(m, "blockOnFailure", true, NotCheck).(bool)
+	esConf.RequestTimeoutMs = getOrDefault(m, "requestTimeoutMs", 60000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BulkMaxActions = getOrDefault(m, "bulkMaxActions", 1000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BulkMaxBytes = getOrDefault(m, "bulkMaxBytes", 5*1024*1024, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.BulkFlushIntervalMs = getOrDefault(m, "bulkFlushIntervalMs", 1000, func(v interface{}) bool { return v.(int) > 0 }).(int)
+	esConf.OmitNull = getOrDefault(m, "omitNull", false, NotCheck).(bool)
 	c.ES = esConf
 }
 
+// checkDocIdTemplate 文档ID模板只能引用主键字段，并且需要引用全部主键字段，否则不同的行会写入同一个文档
+func checkDocIdTemplate(template string, keyCollNames []string) {
+	if template == "" {
+		return
+	}
+	rest := template
+	for _, name := range keyCollNames {
+		if !strings.Contains(template, "{"+name+"}") {
+			log.Panicf("[rule.doc_id] %v 缺少主键字段 %v", template, name)
+		}
+		rest = strings.Replace(rest, "{"+name+"}", "", -1)
+	}
+	if strings.ContainsAny(rest, "{}") {
+		log.Panicf("[rule.doc_id] %v 只能引用主键字段 %v", template, keyCollNames)
+	}
+}
+
 func (c *Conf) initRule(m map[interface{}]interface{}) {
 	rule := &Rule{}
 	joinTableMap := make(map[string]*JoinTable)
@@ -163,24 +447,82 @@ func (c *Conf) initRule(m map[interface{}]interface{}) {
 		collList := make(map[string]*Coll)
 		mappings := getOrDefault(tableInfo, "mapping", make(map[interface{}]interface{}), func(v interface{}) bool { return v != nil }).(map[interface{}]interface{})
 		for k, v := range mappings {
-			collList[k.(string)] = &Coll{k.(string), 0, v.(string), fmt.Sprintf("%v.%v", tableName, k.(string))}
+			coll := &Coll{CollName: k.(string), FullName: fmt.Sprintf("%v.%v", tableName, k.(string))}
+			switch mapping := v.(type) {
+			case string:
+				coll.MappingName = mapping
+			case map[interface{}]interface{}:
+				coll.MappingName = getOrError(mapping, "name", fmt.Sprintf("[rule.%v.mapping.%v.name] 不存在", tableName, k), func(v interface{}) bool { return v != "" }).(string)
+				coll.EsType = getOrDefault(mapping, "type", "", NotCheck).(string)
+				coll.Analyzer = getOrDefault(mapping, "analyzer", "", NotCheck).(string)
+				coll.ExplicitType = coll.EsType != ""
+			default:
+				log.Panicf("[rule.%v.mapping.%v] 格式错误", tableName, k)
+			}
+			collList[k.(string)] = coll
 		}
 		main := getOrDefault(tableInfo, "main", false, func(v interface{}) bool { return v != "" }).(bool)
 		if main {
 			if rule.MainTable != nil {
 				log.Panicf("同时存在多个主表 [%v, %v]", rule.MainTable.TableName, tableName)
 			}
-			mainCollName := getOrError(tableInfo, "main_coll", "[rule.main_coll] 不存在，主表需要有主键字段", func(v interface{}) bool { return v != "" }).(string)
-			rule.MainTable = &MainTable{tableName, collList, mainCollName}
+			var keyCollNames []string
+			switch mainColl := getOrError(tableInfo, "main_coll", "[rule.main_coll] 不存在，主表需要有主键字段", func(v interface{}) bool { return v != "" }).(type) {
+			case string:
+				keyCollNames = []string{mainColl}
+			case []interface{}:
+				for _, name := range mainColl {
+					keyCollNames = append(keyCollNames, fmt.Sprintf("%v", name))
+				}
+			}
+			if len(keyCollNames) == 0 {
+				log.Panic("[rule.main_coll] 格式错误，需要是字段名或字段名列表")
+			}
+			docIdTemplate := getOrDefault(tableInfo, "doc_id", "", NotCheck).(string)
+			if docIdTemplate == "" && len(keyCollNames) > 1 {
+				// 联合主键默认以 _ 连接各主键值
+				docIdTemplate = "{" + strings.Join(keyCollNames, "}_{") + "}"
+			}
+			checkDocIdTemplate(docIdTemplate, keyCollNames)
+			rule.MainTable = &MainTable{tableName, collList, keyCollNames, docIdTemplate}
 		} else {
 			joinColl := getOrError(tableInfo, "join_coll", "[rule.join_coll] 不存在，主表需要有连接主键字段", func(v interface{}) bool { return v != "" }).(string)
 			joinMainColl := getOrError(tableInfo, "join_main_coll", "[rule.join_main_coll] 不存在，主表需要有连接主键字段", func(v interface{}) bool { return v != "" }).(string)
-			joinTableMap[tableName] = &JoinTable{tableName, collList, joinColl, joinMainColl}
+			parentName := getOrDefault(tableInfo, "join_parent", "", NotCheck).(string)
+			joinTable := &JoinTable{TableName: tableName, CollList: collList, JoinCollName: joinColl, MainCollName: joinMainColl, ParentName: parentName}
+			joinTable.Many = getOrDefault(tableInfo, "many", false, NotCheck).(bool)
+			if joinTable.Many {
+				joinTable.ArrayName = getOrError(tableInfo, "array_name", fmt.Sprintf("[rule.%v.array_name] 不存在，一对多连接需要配置数组字段名", tableName), func(v interface{}) bool { return v != "" }).(string)
+				joinTable.ArrayType = getOrDefault(tableInfo, "array_type", "nested", func(v interface{}) bool { return v == "nested" || v == "object" }).(string)
+				joinTable.ArrayColl = &Coll{CollName: joinTable.ArrayName, MappingName: joinTable.ArrayName, FullName: fmt.Sprintf("%v[]", tableName)}
+			}
+			joinTableMap[tableName] = joinTable
 		}
 	}
 	if rule.MainTable == nil {
 		log.Panic("不存在主表")
 	}
 	rule.JoinTables = joinTableMap
+	for _, t := range joinTableMap {
+		if t.ParentName == rule.MainTable.TableName {
+			t.ParentName = ""
+		}
+		if _, e := joinTableMap[t.ParentName]; t.ParentName != "" && !e {
+			log.Panicf("[rule.%v.join_parent] 附表 %v 不存在", t.TableName, t.ParentName)
+		}
+	}
+	for _, t := range joinTableMap {
+		if !t.Many {
+			continue
+		}
+		// 一对多的附表只能直接连接主表，并且不能再作为其他附表的上级
+		if t.ParentName != "" || len(rule.Children(t.TableName)) > 0 {
+			log.Panicf("[rule.%v.many] 一对多连接只支持直接连接主表的附表，且不能有下级附表", t.TableName)
+		}
+	}
+	// 从主表出发无法到达的附表之间存在循环连接
+	if len(rule.Subtree(nil)) != len(joinTableMap) {
+		log.Panic("[rule.join_parent] 附表之间存在循环连接")
+	}
 	c.Rule = rule
 }
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/config"
+	"go-mysql2es/src/db"
+	"go-mysql2es/src/es"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chunk 全量同步中的一批ID范围 [start, end]，按主键分页读取时为本页最后一个主键 last
+type chunk struct {
+	seq   uint64
+	start uint64
+	end   uint64
+	last  []interface{}
+}
+
+type chunkResult struct {
+	chunk      *chunk
+	resultList []map[*config.Coll]interface{}
+}
+
+// chunkTracker 批次可能乱序完成，进度只推进到连续完成的最后一批
+type chunkTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	done     map[uint64]*chunk
+	progress *fullProgress
+	path     string
+}
+
+func (t *chunkTracker) finish(c *chunk) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[c.seq] = c
+	advanced := false
+	for {
+		done, e := t.done[t.next]
+		if !e {
+			break
+		}
+		delete(t.done, t.next)
+		t.progress.LastId = done.end
+		if done.last != nil {
+			t.progress.LastKey = done.last
+		}
+		t.next++
+		advanced = true
+	}
+	if advanced {
+		err := saveFullProgress(t.path, t.progress)
+		if err != nil {
+			log.Panicf("[FULL] 写入全量进度失败, %v", err)
+		}
+	}
+}
+
+// readByRange 将 (LastId, MaxId] 按固定大小切分，由每个快照连接并发读取
+func readByRange(snapshots []*db.DB, progress *fullProgress, size uint64, results chan<- *chunkResult) {
+	chunks := make(chan *chunk)
+	go func() {
+		var seq uint64 = 0
+		for start := progress.LastId + 1; start <= progress.MaxId; start += size {
+			chunks <- &chunk{seq, start, start + size - 1, nil}
+			seq++
+		}
+		close(chunks)
+	}()
+	var readers sync.WaitGroup
+	for _, snapshot := range snapshots {
+		readers.Add(1)
+		go func(snapshot *db.DB) {
+			defer readers.Done()
+			for c := range chunks {
+				results <- &chunkResult{c, snapshot.FullGetByRange(c.start, c.end)}
+			}
+		}(snapshot)
+	}
+	readers.Wait()
+	close(results)
+}
+
+// readByKeyset 按主键顺序逐页读取，每页从上一页的最后一个主键之后开始，读取只能串行进行
+// 每页对应一个批次，写入仍可并发
+func readByKeyset(snapshot *db.DB, progress *fullProgress, limit int, results chan<- *chunkResult) {
+	var seq uint64 = 0
+	last := progress.LastKey
+	for {
+		resultList, end, ok := snapshot.FullGetAfter(last, limit)
+		if !ok {
+			break
+		}
+		results <- &chunkResult{&chunk{seq: seq, last: end}, resultList}
+		seq++
+		last = end
+		if len(resultList) < limit {
+			break
+		}
+	}
+	close(results)
+}
+
+// full 在一致性快照中全量写入 client 对应的索引，返回快照对应的 binlog 位点，增量应从该位点开始
+// ID范围切分成批次（keyset 方式按页读取），由 readers 个协程并发读取、writers 个协程并发写入，最多缓存 queueSize 个批次
+// 每完成一批都会记录进度，进程中途退出后从上次完成的ID继续，增量仍从最初快照的位点开始，重放是幂等的
+// 全量完成后先将位点写入 statusFilePath 再删除进度，保证任何时刻重启都能找到正确的起点
+func (syncer *Syncer) full(client *es.Client, statusFilePath string) *mysql.Position {
+	fullConf := syncer.Conf.FullConf
+	progressFilePath := syncer.filePath("full")
+	progress, err := loadFullProgress(progressFilePath)
+	if err != nil {
+		log.Panicf("[FULL] 读取全量进度失败, %v", err)
+	}
+	strategy := fullConf.Strategy
+	if strategy == config.FullStrategyRange && !syncer.MysqlClient.RangeSupported() {
+		log.Warnf("[FULL] 主键不是单一的整数，使用 %v 方式读取", config.FullStrategyKeyset)
+		strategy = config.FullStrategyKeyset
+	}
+	readers := fullConf.Readers
+	if strategy == config.FullStrategyKeyset {
+		// 分页依赖上一页的结果，只需要一个快照连接
+		readers = 1
+	}
+	snapshots, name, pos := syncer.MysqlClient.StartSnapshot(readers)
+	defer func() {
+		for _, snapshot := range snapshots {
+			snapshot.EndSnapshot()
+		}
+	}()
+	if progress != nil && progress.Index == client.IndexName() {
+		if progress.Strategy == "" {
+			// 旧版本的进度文件没有记录读取方式，按ID范围读取时 MaxId 不为 0
+			progress.Strategy = config.FullStrategyKeyset
+			if progress.MaxId > 0 {
+				progress.Strategy = config.FullStrategyRange
+			}
+		}
+		if progress.Strategy != strategy {
+			log.Panicf("[FULL] 上次全量使用 %v 方式读取，本次为 %v 方式，进度无法继续；请改回 full.strategy: %v，或删除进度文件 %v 重新全量",
+				progress.Strategy, strategy, progress.Strategy, progressFilePath)
+		}
+		log.Infof("[FULL] 从上次进度继续 %v%v -> %v, 位点 %v %v", progress.LastId, progress.LastKey, progress.MaxId, progress.BinLogName, progress.BinLogPos)
+	} else {
+		progress = &fullProgress{Index: client.IndexName(), Strategy: strategy, BinLogName: name, BinLogPos: pos}
+		if strategy == config.FullStrategyRange {
+			minId, maxId := snapshots[0].GetIdRange()
+			progress.LastId, progress.MaxId = minId-1, maxId
+		}
+		err = saveFullProgress(progressFilePath, progress)
+		if err != nil {
+			log.Panicf("[FULL] 写入全量进度失败, %v", err)
+		}
+	}
+
+	results := make(chan *chunkResult, fullConf.QueueSize)
+	tracker := &chunkTracker{done: make(map[uint64]*chunk), progress: progress, path: progressFilePath}
+	if strategy == config.FullStrategyKeyset {
+		go readByKeyset(snapshots[0], progress, fullConf.BatchSize, results)
+	} else {
+		go readByRange(snapshots, progress, uint64(fullConf.ChunkSize), results)
+	}
+
+	var count int64 = 0
+	var startTime = time.Now()
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second) // 每隔10s打印一次吞吐
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			n := atomic.LoadInt64(&count)
+			cost := time.Since(startTime).Seconds()
+			tracker.mu.Lock()
+			var current interface{} = fmt.Sprintf("%v/%v", tracker.progress.LastId, tracker.progress.MaxId)
+			if strategy == config.FullStrategyKeyset {
+				current = tracker.progress.LastKey
+			}
+			tracker.mu.Unlock()
+			log.Infof("[FULL] execute: %v cost: %.0fs rate: %.0f/s progress: %v queue: %v",
+				n, cost, float64(n)/cost, current, len(results))
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < fullConf.Writers; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for r := range results {
+				err := client.BatchInsert(r.resultList)
+				if bulkErr, ok := err.(*es.BulkError); ok && !es.IsRetryable(err) {
+					log.Errorf("[FULL] %v 写入失败的文档: %v", bulkErr, bulkErr.Ids())
+					syncer.writeDeadLetter(r.resultList, bulkErr)
+				} else if err != nil {
+					// 未能写入的批次不记录进度，重启后从这里继续
+					log.Panicf("[FULL] 写入失败, %v", err)
+				}
+				atomic.AddInt64(&count, int64(len(r.resultList)))
+				tracker.finish(r.chunk)
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+
+	position := &mysql.Position{Name: progress.BinLogName, Pos: progress.BinLogPos}
+	err = savePosition(statusFilePath, *position)
+	if err != nil {
+		log.Panicf("[FULL] 写入状态文件失败, %v", err)
+	}
+	_ = os.Remove(progressFilePath)
+	log.Infof("[FULL] finished!!! count: %v cost: %v position: %v %v", count, time.Since(startTime), position.Name, position.Pos)
+	return position
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/utils"
+	"os"
+	"regexp"
+	"time"
+)
+
+// 追赶增量时连续空闲该秒数后视为已经追上目标位点
+const catchUpIdleSeconds = 3
+
+// Reindex 在新的版本索引（如 test_index_v2）中重建数据，追上 binlog 后原子地将别名切换到新索引，之后继续增量同步
+// 全量期间的变更由 MySQL 的 binlog 缓冲，切换前旧索引仍然可以正常查询，但不再更新，需要先停止正常的同步进程
+// 重建的目标索引与阶段记录在重建状态文件中，进程中途退出后再次 -reindex 从全量进度或 reindex.status 的位点继续
+func (syncer *Syncer) Reindex(deleteOld bool) {
+	alias := syncer.Conf.ES.Index
+	stateFilePath := syncer.filePath("reindex")
+	reindexStatusFilePath := syncer.filePath("reindex.status")
+	state, err := loadReindexState(stateFilePath)
+	if err != nil {
+		log.Panicf("[REINDEX] 读取重建状态失败, %v", err)
+	}
+	if state == nil {
+		// 上一次重建遗留的追赶位点不能用于新的重建
+		_ = os.Remove(reindexStatusFilePath)
+		state = syncer.newReindexState(alias)
+		err = saveReindexState(stateFilePath, state)
+		if err != nil {
+			log.Panicf("[REINDEX] 写入重建状态失败, %v", err)
+		}
+	} else {
+		log.Infof("[REINDEX] 继续上次未完成的重建 %v, 阶段 %v", state.Index, state.Phase)
+	}
+	newIndex := state.Index
+	exists, err := syncer.EsClient.IndexExists(newIndex)
+	if err != nil {
+		log.Panicf("[REINDEX] 获取索引 %v 失败, %v", newIndex, err)
+	}
+	if !exists {
+		err = syncer.EsClient.CreateIndex(newIndex)
+		if err != nil {
+			log.Panicf("[REINDEX] 创建索引 %v 失败, %v", newIndex, err)
+		}
+	}
+	client := syncer.EsClient.WithIndex(newIndex)
+
+	if state.Phase == reindexPhaseFull {
+		// 全量完成后、记录阶段前退出时全量进度已删除，reindex.status 中已有快照位点，无需重新全量
+		_, done, _ := loadPosition(reindexStatusFilePath)
+		if !done || utils.IsFile(syncer.filePath("full")) {
+			log.Infof("[REINDEX] 开始重建 %v -> %v", alias, newIndex)
+			syncer.full(client, reindexStatusFilePath)
+		}
+		// 追赶的目标为全量结束时的位点
+		name, pos := syncer.MysqlClient.GetMasterPosition()
+		state.Phase, state.TargetName, state.TargetPos = reindexPhaseCatchUp, name, pos
+		err = saveReindexState(stateFilePath, state)
+		if err != nil {
+			log.Panicf("[REINDEX] 写入重建状态失败, %v", err)
+		}
+	}
+
+	// 从 reindex.status 的位点追赶全量期间产生的变更，直到已确认的位点超过目标位点
+	position, ok, err := loadPosition(reindexStatusFilePath)
+	if err != nil || !ok {
+		log.Panicf("[REINDEX] 读取追赶位点失败 %v, %v", reindexStatusFilePath, err)
+	}
+	target := mysql.Position{Name: state.TargetName, Pos: state.TargetPos}
+	c, h, stopped := syncer.startIncr(client, position, reindexStatusFilePath)
+	// 位点只在事务提交、rotate、DDL 处推进，目标位点之前最后的事件不是这些时（如刚 rotate 后只有 format description），
+	// 位点会一直停在目标之前；已进入目标所在的文件、没有未确认的事件且连续几秒没有新的事件时视为已经追上
+	idle, last := 0, h.Checkpoint.Events()
+	for {
+		cp := h.Checkpoint.Position()
+		if cp.Compare(target) >= 0 {
+			break
+		}
+		events := h.Checkpoint.Events()
+		if cp.Name == target.Name && h.Checkpoint.Pending() == 0 && events == last {
+			idle++
+		} else {
+			idle = 0
+		}
+		last = events
+		if idle >= catchUpIdleSeconds {
+			log.Infof("[REINDEX] binlog 已无新的事件，%v 视为追上 %v", cp, target)
+			break
+		}
+		log.Infof("[REINDEX] 追赶增量 %v -> %v", cp, target)
+		time.Sleep(time.Second)
+	}
+
+	// 切换后、写入状态文件前退出时别名已经指向新索引，不能重复切换
+	current, err := syncer.EsClient.AliasIndices(alias)
+	if err != nil {
+		log.Panicf("[REINDEX] 获取别名 %v 失败, %v", alias, err)
+	}
+	if len(current) != 1 || current[0] != newIndex {
+		err = syncer.EsClient.SwapAlias(alias, newIndex, state.OldIndices, state.RemoveIndex)
+		if err != nil {
+			log.Panicf("[REINDEX] 切换别名失败, %v", err)
+		}
+	}
+	// 停止 canal 后等待已派发的变更写入新索引，之后的位点不再变化，增量从这里由新的 handler 继续
+	c.Close()
+	<-stopped
+	h.Close()
+	p := h.Checkpoint.Position()
+	statusFilePath := syncer.filePath("status")
+	err = savePosition(statusFilePath, p)
+	if err != nil {
+		log.Panicf("[REINDEX] 写入状态文件失败, %v", err)
+	}
+	_ = os.Remove(reindexStatusFilePath)
+	_ = os.Remove(stateFilePath)
+	if deleteOld {
+		for _, old := range state.OldIndices {
+			err = syncer.EsClient.DeleteIndex(old)
+			if err != nil {
+				log.Errorf("[REINDEX] 删除旧索引 %v 失败, %v", old, err)
+			}
+		}
+	}
+	log.Infof("[REINDEX] 重建完成 %v -> %v", alias, newIndex)
+	syncer.incr(&p, statusFilePath)
+}
+
+// newReindexState 确定新的版本索引与切换时需要移除的旧索引
+func (syncer *Syncer) newReindexState(alias string) *reindexState {
+	oldIndices, err := syncer.EsClient.AliasIndices(alias)
+	if err != nil {
+		log.Panicf("[REINDEX] 获取别名 %v 失败, %v", alias, err)
+	}
+	// 旧的数据直接写在与别名同名的索引中，切换时需要同时删除该索引
+	removeIndex := false
+	if len(oldIndices) == 0 {
+		removeIndex, err = syncer.EsClient.IndexExists(alias)
+		if err != nil {
+			log.Panicf("[REINDEX] 获取索引 %v 失败, %v", alias, err)
+		}
+	}
+	progress, err := loadFullProgress(syncer.filePath("full"))
+	if err != nil {
+		log.Panicf("[REINDEX] 读取全量进度失败, %v", err)
+	}
+	var newIndex string
+	if progress != nil && progress.Index != alias {
+		// 旧版本没有重建状态文件，从全量进度中继续上次未完成的重建
+		newIndex = progress.Index
+		oldIndices = removeString(oldIndices, newIndex)
+	} else {
+		newIndex = syncer.nextIndexName(alias, oldIndices)
+	}
+	return &reindexState{Index: newIndex, OldIndices: oldIndices, RemoveIndex: removeIndex, Phase: reindexPhaseFull}
+}
+
+// nextIndexName 在别名后追加递增的版本号，跳过已经存在的索引
+func (syncer *Syncer) nextIndexName(alias string, oldIndices []string) string {
+	pattern := regexp.MustCompile(fmt.Sprintf(`^%v_v(\d+)$`, regexp.QuoteMeta(alias)))
+	version := 0
+	for _, index := range oldIndices {
+		match := pattern.FindStringSubmatch(index)
+		if match != nil {
+			var v int
+			_, _ = fmt.Sscanf(match[1], "%d", &v)
+			if v > version {
+				version = v
+			}
+		}
+	}
+	for {
+		version++
+		name := fmt.Sprintf("%v_v%v", alias, version)
+		exists, err := syncer.EsClient.IndexExists(name)
+		if err != nil {
+			log.Panicf("[REINDEX] 获取索引 %v 失败, %v", name, err)
+		}
+		if !exists {
+			return name
+		}
+	}
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/dlq"
+)
+
+// Replay 将死信文件中的记录重新写入ES，再次失败的记录写入 <path>.failed
+// 建议先将死信文件移走再重放，避免与正在运行的同步进程同时写同一个文件
+func (syncer *Syncer) Replay(path string) {
+	err := syncer.EsClient.DetectVersion()
+	if err != nil {
+		log.Panicf("[REPLAY] 获取ES版本失败, %v", err)
+	}
+	records, err := dlq.Read(path)
+	if err != nil {
+		log.Panicf("[REPLAY] 读取死信文件 %v 失败, %v", path, err)
+	}
+	var failed *dlq.Writer
+	var success, failure int
+	for _, r := range records {
+		switch r.Action {
+		case dlq.ActionDelete:
+			err = syncer.EsClient.Delete(r.Id)
+		case dlq.ActionUpdate:
+			err = syncer.EsClient.Update(r.Id, r.Doc, r.Upsert)
+		default:
+			err = syncer.EsClient.Index(r.Id, r.Doc)
+		}
+		if err == nil {
+			success++
+			continue
+		}
+		failure++
+		log.Errorf("[REPLAY] %v %v 重放失败, %v", r.Action, r.Id, err)
+		r.Error = err.Error()
+		r.Time = ""
+		if failed == nil {
+			failed, err = dlq.New(path + ".failed")
+			if err != nil {
+				log.Panicf("[REPLAY] 打开 %v.failed 失败, %v", path, err)
+			}
+		}
+		err = failed.Write(r)
+		if err != nil {
+			log.Panicf("[REPLAY] 写入 %v.failed 失败, %v", path, err)
+		}
+	}
+	if failed != nil {
+		_ = failed.Close()
+	}
+	log.Infof("[REPLAY] %v 共%v条，成功%v条，失败%v条", path, len(records), success, failure)
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"go-mysql2es/src/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// loadPosition 从状态文件中读取上次确认的位点，文件不存在时返回 false
+func loadPosition(statusFilePath string) (*mysql.Position, bool, error) {
+	if !utils.IsFile(statusFilePath) {
+		return nil, false, nil
+	}
+	lines, err := utils.File2list(statusFilePath, utils.CommonHandler)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, false, nil
+	}
+	info := strings.Split(lines[0], "\t")
+	if len(info) != 2 {
+		return nil, false, fmt.Errorf("状态文件格式错误 %v", lines[0])
+	}
+	return &mysql.Position{Name: info[0], Pos: uint32(utils.Str2Int(info[1]))}, true, nil
+}
+
+func savePosition(statusFilePath string, p mysql.Position) error {
+	return writeFileAtomic(statusFilePath, []byte(fmt.Sprintf("%v\t%v", p.Name, p.Pos)))
+}
+
+// writeFileAtomic 先写临时文件并 fsync 再 rename，避免进程退出或宕机时留下半截的状态文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	// rename 修改的是目录项，同步目录后宕机也能看到新文件；部分平台不支持同步目录，忽略失败
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// fullProgress 全量同步进度，全量完成并写入增量位点后删除
+type fullProgress struct {
+	// 写入的目标索引
+	Index string `json:"index"`
+	// 读取方式，两种方式记录的进度互不通用
+	Strategy string `json:"strategy"`
+	// 按ID范围读取时已完成的最大主表ID
+	LastId uint64 `json:"last_id"`
+	MaxId  uint64 `json:"max_id"`
+	// 按主键分页读取时已完成的最后一个主键，支持字符串与联合主键
+	LastKey []interface{} `json:"last_key,omitempty"`
+	// 全量开始时快照对应的位点
+	BinLogName string `json:"binlog_name"`
+	BinLogPos  uint32 `json:"binlog_pos"`
+}
+
+// loadFullProgress 读取未完成的全量同步进度，不存在时返回 nil
+func loadFullProgress(path string) (*fullProgress, error) {
+	if !utils.IsFile(path) {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	progress := &fullProgress{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	// 主键中的大整数按 float64 解析会丢失精度
+	decoder.UseNumber()
+	err = decoder.Decode(progress)
+	if err != nil {
+		return nil, fmt.Errorf("全量进度文件格式错误 %v", err)
+	}
+	for i, v := range progress.LastKey {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i64, err := n.Int64(); err == nil {
+			progress.LastKey[i] = i64
+		} else if u64, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			progress.LastKey[i] = u64
+		} else {
+			progress.LastKey[i] = n.String()
+		}
+	}
+	return progress, nil
+}
+
+func saveFullProgress(path string, progress *fullProgress) error {
+	content, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+const (
+	reindexPhaseFull    = "full"
+	reindexPhaseCatchUp = "catchup"
+)
+
+// reindexState 重建索引的状态，重建完成后删除，进程中途退出后按该状态继续
+type reindexState struct {
+	// 新的版本索引
+	Index string `json:"index"`
+	// 切换别名时移除的旧索引，旧数据直接写在与别名同名的索引中时 RemoveIndex 为 true
+	OldIndices  []string `json:"old_indices"`
+	RemoveIndex bool     `json:"remove_index"`
+	// full 全量中，catchup 追赶增量中，追赶的位点记录在 reindex.status 中
+	Phase string `json:"phase"`
+	// 追赶的目标位点，进入 catchup 时确定
+	TargetName string `json:"target_name,omitempty"`
+	TargetPos  uint32 `json:"target_pos,omitempty"`
+}
+
+// loadReindexState 读取未完成的重建状态，不存在时返回 nil
+func loadReindexState(path string) (*reindexState, error) {
+	if !utils.IsFile(path) {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &reindexState{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("重建状态文件格式错误 %v", err)
+	}
+	return state, nil
+}
+
+func saveReindexState(path string, state *reindexState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
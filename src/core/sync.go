@@ -8,9 +8,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"go-mysql2es/src/config"
 	"go-mysql2es/src/db"
+	"go-mysql2es/src/dlq"
 	"go-mysql2es/src/es"
 	"go-mysql2es/src/handler"
 	"go-mysql2es/src/utils"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -20,18 +22,84 @@ type Syncer struct {
 	Conf        *config.Conf
 	EsClient    *es.Client
 	MysqlClient *db.DB
+	DeadLetter  *dlq.Writer
 }
 
 func New(conf *config.Conf) *Syncer {
-	return &Syncer{conf, es.New(conf), db.New(conf)}
+	syncer := &Syncer{conf, es.New(conf), db.New(conf), nil}
+	syncer.migrateFiles()
+	deadLetterPath := conf.DeadLetterConf.FilePath
+	if deadLetterPath == "" {
+		deadLetterPath = syncer.filePath("dlq")
+	}
+	deadLetter, err := dlq.New(deadLetterPath)
+	if err != nil {
+		log.Panicf("打开死信文件 %v 失败, %v", deadLetterPath, err)
+	}
+	syncer.DeadLetter = deadLetter
+	return syncer
+}
+
+// filePath 返回同步进度目录下属于当前索引的文件路径
+// 文件名只由索引决定，改用 nodes 或者更换节点地址后仍然能找到原来的进度
+func (syncer *Syncer) filePath(suffix string) string {
+	hashKey := fmt.Sprintf("%v%v", syncer.Conf.ES.Index, syncer.Conf.ES.Type)
+	return fmt.Sprintf("%v/%v.%v", syncer.Conf.BinLogConf.BinLogStatusFilePath, utils.GetHashFromStr(hashKey), suffix)
+}
+
+// migrateFiles 旧版本的文件名还包含 ES 的 host、port（配置 nodes 时为空），存在时改为当前的文件名
+func (syncer *Syncer) migrateFiles() {
+	esConf := syncer.Conf.ES
+	hashKeys := []string{fmt.Sprintf("%v%v", esConf.Host, esConf.Port)}
+	for _, node := range esConf.Nodes {
+		if u, err := url.Parse(node); err == nil && u.Port() != "" {
+			hashKeys = append(hashKeys, u.Hostname()+u.Port())
+		}
+	}
+	for _, suffix := range []string{"status", "full", "reindex.status", "dlq"} {
+		path := syncer.filePath(suffix)
+		if utils.IsFile(path) {
+			continue
+		}
+		for _, hashKey := range hashKeys {
+			legacy := fmt.Sprintf("%v/%v.%v", syncer.Conf.BinLogConf.BinLogStatusFilePath,
+				utils.GetHashFromStr(fmt.Sprintf("%v%v%v", hashKey, esConf.Index, esConf.Type)), suffix)
+			if !utils.IsFile(legacy) {
+				continue
+			}
+			if err := os.Rename(legacy, path); err != nil {
+				log.Panicf("迁移同步进度文件 %v 失败, %v", legacy, err)
+			}
+			log.Infof("同步进度文件 %v 迁移为 %v", legacy, path)
+			break
+		}
+	}
 }
 
 func (syncer *Syncer) Prepare() {
 	// 使用 MYSQL 表信息补全列类型
 	syncer.MysqlClient.FillCollType()
+	// 使用 binlog 行数据时需要完整的行镜像，否则退回到查询 MySQL
+	if syncer.Conf.BinLogConf.UseRowImage {
+		ok, reason := syncer.MysqlClient.CheckRowImage()
+		if !ok {
+			log.Warnf("[PREPARE] 无法使用 binlog 行数据构建文档，改为查询 MySQL, %v", reason)
+			syncer.Conf.BinLogConf.UseRowImage = false
+		}
+	}
+	// 识别ES版本，决定是否使用 mapping type
+	err := syncer.EsClient.DetectVersion()
+	if err != nil {
+		log.Panicf("[PREPARE] 获取ES版本失败, %v", err)
+	}
 }
 
 func (syncer *Syncer) Run() {
+	// 按配置的字段类型创建索引，已有索引的 mapping 不兼容时直接退出
+	err := syncer.EsClient.EnsureIndex()
+	if err != nil {
+		log.Panicf("[PREPARE] 初始化索引失败, %v", err)
+	}
 	count, err := syncer.EsClient.Count()
 	if err != nil {
 		log.Panicf("获取索引状态失败, %v", err)
@@ -40,27 +108,27 @@ func (syncer *Syncer) Run() {
 		Name: "",
 		Pos:  0,
 	}
-	hashKey := fmt.Sprintf("%v%v%v%v", syncer.Conf.ES.Host, syncer.Conf.ES.Port, syncer.Conf.ES.Index, syncer.Conf.ES.Type)
-	statusFilePath := fmt.Sprintf("%v/%v.status", syncer.Conf.BinLogConf.BinLogStatusFilePath, utils.GetHashFromStr(hashKey))
-	if count == 0 {
-		syncer.full()
-		if syncer.Conf.BinLogConf.StartBinLogName == "" {
-			position.Name = syncer.MysqlClient.GetOldestBinlogName()
-			position.Pos = 0
-		} else {
-			position.Name = syncer.Conf.BinLogConf.StartBinLogName
-			position.Pos = uint32(syncer.Conf.BinLogConf.StartBinLogPosition)
-		}
-
+	statusFilePath := syncer.filePath("status")
+	progress, err := loadFullProgress(syncer.filePath("full"))
+	if err != nil {
+		log.Panicf("[FULL] 读取全量进度失败, %v", err)
+	}
+	if progress != nil && progress.Index != syncer.Conf.ES.Index {
+		log.Panicf("上次重建索引 %v 未完成，请使用 -reindex 继续", progress.Index)
+	}
+	if state, _ := loadReindexState(syncer.filePath("reindex")); state != nil {
+		log.Panicf("上次重建索引 %v 未完成，请使用 -reindex 继续", state.Index)
+	}
+	if count == 0 || progress != nil {
+		// 全量快照对应的位点即为增量的起点
+		position = syncer.full(syncer.EsClient, statusFilePath)
 	} else {
-		if utils.IsFile(statusFilePath) {
-			lines, err := utils.File2list(statusFilePath, utils.CommonHandler)
-			if err != nil {
-				log.Panicf("读取状态文件错误, %v", err)
-			}
-			info := strings.Split(lines[0], "\t")
-			position.Name = info[0]
-			position.Pos = uint32(utils.Str2Int(info[1]))
+		p, ok, err := loadPosition(statusFilePath)
+		if err != nil {
+			log.Panicf("读取状态文件错误, %v", err)
+		}
+		if ok {
+			position = p
 		} else {
 			if syncer.Conf.BinLogConf.StartBinLogName == "" {
 				position.Name = syncer.MysqlClient.GetOldestBinlogName()
@@ -75,6 +143,16 @@ func (syncer *Syncer) Run() {
 }
 
 func (syncer *Syncer) incr(position *mysql.Position, statusFilePath string) {
+	syncer.startIncr(syncer.EsClient, position, statusFilePath)
+	<-make(chan bool)
+}
+
+// 最早未确认的写入超过该时间后持续报错
+const stuckWarnTime = time.Minute
+
+// startIncr 从指定位点开始消费 binlog 写入 client 对应的索引，canal 关闭后相关协程随之退出
+// 返回的 channel 在 canal 停止消费后关闭
+func (syncer *Syncer) startIncr(client *es.Client, position *mysql.Position, statusFilePath string) (*canal.Canal, *handler.EsSyncHandler, <-chan struct{}) {
 	log.Infof("[INCR] 准备开始同步..., %v %v", position.Name, position.Pos)
 	cfg := canal.NewDefaultConfig()
 	cfg.Addr = fmt.Sprintf("%v:%v", syncer.Conf.MySQL.Host, syncer.Conf.MySQL.Port)
@@ -85,6 +163,8 @@ func (syncer *Syncer) incr(position *mysql.Position, statusFilePath string) {
 	cfg.ReadTimeout = time.Duration(syncer.Conf.MySQL.ReadTimeoutMs) * time.Millisecond
 	cfg.HeartbeatPeriod = time.Duration(syncer.Conf.MySQL.HeartbeatPeriodMs) * time.Millisecond
 	cfg.ServerID = syncer.Conf.MySQL.ServerID
+	// binlog 中的 TIMESTAMP 按 UTC 转为字符串，与全量查询的会话时区一致
+	cfg.TimestampStringLocation = time.UTC
 	cfg.Dump.ExecutionPath = ""
 	var syncTables []string
 	//只同步需要的表
@@ -97,27 +177,46 @@ func (syncer *Syncer) incr(position *mysql.Position, statusFilePath string) {
 	if err != nil {
 		log.Panicf("[INCR] 建立 canal 失败, %v", err)
 	}
-	h := handler.New(syncer.Conf.Rule, syncer.EsClient, syncer.MysqlClient)
+	h := handler.New(syncer.Conf, client, syncer.MysqlClient, *position, syncer.DeadLetter)
 	c.SetEventHandler(h)
+	stopped := make(chan struct{})
 	go func() {
-		err = c.RunFrom(*position)
+		err := c.RunFrom(*position)
 		if err != nil {
-			log.Panicf("[INCR] 启动 canal 失败, %v", err)
+			log.Panicf("[INCR] 同步中断, %v", err)
 		}
+		close(stopped)
 	}()
 	go func() {
 		ticker := time.NewTicker(time.Second) // 每隔1s进行一次打印
+		defer ticker.Stop()
 		for {
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-c.Ctx().Done():
+				return
+			}
 			p := c.SyncedPosition()
+			cp := h.Checkpoint.Position()
 			mp, _ := c.GetMasterPos()
-			log.Infof("[INCR] P: %v -> %v MP: %v -> %v delay: %v ...", p.Name, p.Pos, mp.Name, mp.Pos, c.GetDelay())
+			log.Infof("[INCR] P: %v -> %v CP: %v -> %v (pending: %v) MP: %v -> %v delay: %v ...",
+				p.Name, p.Pos, cp.Name, cp.Pos, h.Checkpoint.Pending(), mp.Name, mp.Pos, c.GetDelay())
+			// 最早的 event 长时间未确认时位点无法推进，未确认的 event 会持续堆积
+			if pos, wait, ok := h.Checkpoint.Oldest(); ok && wait > stuckWarnTime {
+				log.Errorf("[INCR] %v %v 的写入已 %.0fs 未确认，位点停止推进，未确认的事件 %v 个，请检查ES写入错误",
+					pos.Name, pos.Pos, wait.Seconds(), h.Checkpoint.Pending())
+			}
 		}
 	}()
 	go func() {
-		ticker := time.NewTicker(time.Second * 60) // 每隔1s进行一次打印
+		ticker := time.NewTicker(time.Second * 60) // 每隔60s打印一次统计
+		defer ticker.Stop()
 		for {
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-c.Ctx().Done():
+				return
+			}
 			stat := h.RefreshAndGetStat()
 			var lines []string
 			for tableName, st := range stat {
@@ -127,39 +226,40 @@ func (syncer *Syncer) incr(position *mysql.Position, statusFilePath string) {
 		}
 	}()
 	go func() {
-		ticker := time.NewTicker(time.Second) // 每隔1s将当前状态写入到状态文件
+		ticker := time.NewTicker(time.Second) // 每隔1s将已被ES确认的位点写入到状态文件
+		defer ticker.Stop()
+		var last mysql.Position
 		for {
-			<-ticker.C
-			f, err := os.OpenFile(statusFilePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+			select {
+			case <-ticker.C:
+			case <-c.Ctx().Done():
+				return
+			}
+			p := h.Checkpoint.Position()
+			if p.Name == "" || p.Compare(last) == 0 {
+				continue
+			}
+			err := savePosition(statusFilePath, p)
 			if err != nil {
 				log.Error(err)
 			} else {
-				p := c.SyncedPosition()
-				line := fmt.Sprintf("%v\t%v", p.Name, p.Pos)
-				n, _ := f.Seek(0, os.SEEK_END)
-				_, err = f.WriteAt([]byte(line), n)
-				_ = f.Close()
+				last = p
 			}
 		}
 	}()
-	<-make(chan bool)
+	return c, h, stopped
 }
 
-func (syncer *Syncer) full() {
-	minId, maxId := syncer.MysqlClient.GetIdRange()
-	var count = 0
-	var startTime = time.Now().Unix()
-	start := minId
-	for start <= maxId {
-		resultList := syncer.MysqlClient.FullGetByRange(start, start+1000)
-		start += 1000
-		err := syncer.EsClient.BatchInsert(resultList)
+func (syncer *Syncer) writeDeadLetter(resultList []map[*config.Coll]interface{}, bulkErr *es.BulkError) {
+	docs := make(map[string]map[string]interface{})
+	for _, result := range resultList {
+		action := syncer.EsClient.IndexAction(result)
+		docs[fmt.Sprintf("%v", action.Id)] = action.Doc
+	}
+	for _, item := range bulkErr.Items {
+		err := syncer.DeadLetter.Write(&dlq.Record{Id: item.Id, Action: dlq.ActionIndex, Doc: docs[item.Id], Error: item.Error()})
 		if err != nil {
-			log.Error(err)
+			log.Errorf("[FULL] 写入死信文件失败 %v, %v", item.Id, err)
 		}
-		count += len(resultList)
-		cost := time.Now().Unix() - startTime
-		log.Infof("[FULL] execute: %v cost: %v avg: %v", count, cost, float64(cost)/float64(count))
 	}
-	log.Infof("[FULL] finished!!! cost: %v", time.Now().Unix()-startTime)
 }
@@ -1,11 +1,20 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 	"go-mysql2es/src/config"
+	"go-mysql2es/src/utils"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const Unknown uint8 = 0
@@ -26,28 +35,163 @@ const SmallInt uint8 = 7
 
 const UnsignedSmallInt uint8 = 8
 
+const MediumInt uint8 = 9
+
+const FLOAT uint8 = 10
+
+const DOUBLE uint8 = 11
+
+const DECIMAL uint8 = 12
+
+const DATE uint8 = 13
+
+const DATETIME uint8 = 14
+
+const TIMESTAMP uint8 = 15
+
+const TIME uint8 = 16
+
+const YEAR uint8 = 17
+
+const CHAR uint8 = 18
+
+const JSON uint8 = 19
+
+const ENUM uint8 = 20
+
+const SET uint8 = 21
+
+const BIT uint8 = 22
+
+const BLOB uint8 = 23
+
+const BINARY uint8 = 24
+
+const GEOMETRY uint8 = 25
+
 type DB struct {
-	db               *sql.DB
-	rule             *config.Rule
-	rangeSearchModel string
-	idSearchModel    string
-	colls            []*config.Coll
+	db   *sql.DB
+	rule *config.Rule
+	// SELECT ... FROM ... LEFT JOIN ...，查询时拼接 WHERE 条件
+	selectModel string
+	colls       []*config.Coll
+	keyColls    []*config.Coll
+	manyTables  []*config.JoinTable
+	// 一致性快照使用的连接，全量读取都在该连接的事务中进行
+	conn *sql.Conn
+	// DECIMAL 以数字而不是字符串写入ES
+	decimalAsNumber bool
+	stmts           *stmtCache
+	// DATETIME 列所在的时区，为 nil 时不带时区写入
+	datetimeLoc *time.Location
 }
 
 func New(conf *config.Conf) *DB {
 	mysqlConf := conf.MySQL
-	uri := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mysqlConf.User, mysqlConf.Password, mysqlConf.Host, mysqlConf.Port, mysqlConf.Database)
+	// 会话时区设为 UTC，TIMESTAMP 与 binlog 中的一样按 UTC 返回
+	uri := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?time_zone=%v", mysqlConf.User, mysqlConf.Password, mysqlConf.Host, mysqlConf.Port, mysqlConf.Database,
+		url.QueryEscape("'+00:00'"))
 	db, err := sql.Open("mysql", uri)
 	if err != nil {
 		log.Panicf("[DB] 连接 %v 失败... %v", uri, err)
 	}
-	return &DB{db, conf.Rule, "", "", nil}
+	var datetimeLoc *time.Location
+	if mysqlConf.DatetimeZone != "" {
+		datetimeLoc, err = time.LoadLocation(mysqlConf.DatetimeZone)
+		if err != nil {
+			log.Panicf("[mysql.datetimeZone] 无法识别的时区 %v, %v", mysqlConf.DatetimeZone, err)
+		}
+	}
+	return &DB{db, conf.Rule, "", nil, nil, nil, nil, mysqlConf.DecimalEncoding == config.DecimalNumber, newStmtCache(), datetimeLoc}
+}
+
+// query 使用缓存的预编译语句执行查询，参数全部通过占位符传递
+func (d *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := d.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(context.Background(), args...)
+}
+
+// StartSnapshot 开启 n 个处于同一一致性快照的连接，返回在这些快照上读取的 DB 以及快照对应的 binlog 位点
+// 使用 FLUSH TABLES WITH READ LOCK 保证位点与快照完全一致；没有 RELOAD 权限时先取位点再开启快照，
+// 此时位点可能略早于快照，增量从该位点重放时会重新查询最新数据，结果同样正确
+func (d *DB) StartSnapshot(n int) ([]*DB, string, uint32) {
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < n; i++ {
+		conn, err := d.db.Conn(ctx)
+		if err != nil {
+			log.Panicf("[DB] 获取连接失败... %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	_, err := conns[0].ExecContext(ctx, "FLUSH TABLES WITH READ LOCK")
+	locked := err == nil
+	if !locked {
+		log.Warnf("[DB] FLUSH TABLES WITH READ LOCK 失败，使用不加锁的快照... %v", err)
+	}
+	var name string
+	var pos uint32
+	if !locked {
+		name, pos = d.masterPosition(conns[0])
+	}
+	for _, conn := range conns {
+		_, err = conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+		if err != nil {
+			log.Panicf("[DB] 设置隔离级别失败... %v", err)
+		}
+		_, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT")
+		if err != nil {
+			log.Panicf("[DB] 开启一致性快照失败... %v", err)
+		}
+	}
+	if locked {
+		name, pos = d.masterPosition(conns[0])
+		_, err = conns[0].ExecContext(ctx, "UNLOCK TABLES")
+		if err != nil {
+			log.Panicf("[DB] UNLOCK TABLES 失败... %v", err)
+		}
+	}
+	log.Infof("[DB] 开启 %v 个一致性快照 %v %v", n, name, pos)
+	var snapshots []*DB
+	for _, conn := range conns {
+		snapshot := *d
+		snapshot.conn = conn
+		snapshot.stmts = newStmtCache()
+		snapshots = append(snapshots, &snapshot)
+	}
+	return snapshots, name, pos
+}
+
+// EndSnapshot 结束快照事务并归还连接
+func (d *DB) EndSnapshot() {
+	if d.conn == nil {
+		return
+	}
+	d.stmts.close()
+	_, err := d.conn.ExecContext(context.Background(), "COMMIT")
+	if err != nil {
+		log.Errorf("[DB] 结束一致性快照失败... %v", err)
+	}
+	_ = d.conn.Close()
+	d.conn = nil
+}
+
+func (d *DB) masterPosition(conn *sql.Conn) (string, uint32) {
+	rows, err := conn.QueryContext(context.Background(), "SHOW MASTER STATUS")
+	if err != nil {
+		log.Panicf("[DB] 获取BINLOG位点失败... %v", err)
+	}
+	defer func() { _ = rows.Close() }()
+	return scanMasterStatus(rows)
 }
 
 func (d *DB) FillCollType() {
 	rule := d.rule
 	mainTable := rule.MainTable
-	rows, err := d.db.Query(fmt.Sprintf("DESC %v", mainTable.TableName))
+	rows, err := d.db.Query(fmt.Sprintf("DESC `%v`", mainTable.TableName))
 	if err != nil {
 		log.Panicf("[PREPARE] 获取表元数据 %v 失败... %v", mainTable.TableName, err)
 	}
@@ -78,7 +222,7 @@ func (d *DB) FillCollType() {
 		}
 	}
 	for k, v := range rule.JoinTables {
-		rows, err := d.db.Query(fmt.Sprintf("DESC %v", k))
+		rows, err := d.db.Query(fmt.Sprintf("DESC `%v`", k))
 		if err != nil {
 			log.Panicf("[PREPARE] 获取表元数据 %v 失败... %v", k, err)
 		}
@@ -109,19 +253,59 @@ func (d *DB) FillCollType() {
 			}
 		}
 	}
+	// 一对多的附表按主表的连接字段聚合，连接字段必须被同步
+	for _, table := range rule.JoinTables {
+		if _, e := mainTable.CollList[table.MainCollName]; table.Many && !e {
+			log.Panicf("[PREPARE] 连接字段 %v.%v 需要配置同步", mainTable.TableName, table.MainCollName)
+		}
+	}
+	// 主键用于生成文档ID与按ID查询，必须被同步
+	for _, name := range mainTable.KeyCollNames {
+		if _, e := mainTable.CollList[name]; !e {
+			log.Panicf("[PREPARE] 主键字段 %v.%v 需要配置同步", mainTable.TableName, name)
+		}
+	}
+	// 查询模板在并发读取前生成
+	d.buildModel()
+	// 未配置ES字段类型的列按MySQL类型推导
+	for _, coll := range rule.MainTable.CollList {
+		if coll.EsType == "" {
+			coll.EsType = GetEsType(coll.CollType)
+		}
+	}
+	for _, table := range rule.JoinTables {
+		for _, coll := range table.CollList {
+			if coll.EsType == "" {
+				coll.EsType = GetEsType(coll.CollType)
+			}
+		}
+	}
+}
+
+// RangeSupported 只有单一的整数主键才能按ID范围切分
+func (d *DB) RangeSupported() bool {
+	if len(d.keyColls) != 1 {
+		return false
+	}
+	switch d.keyColls[0].CollType {
+	case INT, BIGINT, TINYINT, SmallInt, MediumInt, UnsignedBigint, UnsignedSmallInt:
+		return true
+	}
+	return false
 }
 
 func (d *DB) GetIdRange() (uint64, uint64) {
-	rows, err := d.db.Query(fmt.Sprintf("SELECT MAX(`%v`), MIN(`%v`) FROM `%v`", d.rule.MainTable.MainCollName, d.rule.MainTable.MainCollName, d.rule.MainTable.TableName))
+	keyName := d.rule.MainTable.KeyCollNames[0]
+	rows, err := d.query(fmt.Sprintf("SELECT MAX(`%v`), MIN(`%v`) FROM `%v`", keyName, keyName, d.rule.MainTable.TableName))
 	if err != nil {
-		log.Panicf("[DB] 获取 %v ID范围失败... %v", d.rule.MainTable.MainCollName, err)
+		log.Panicf("[DB] 获取 %v ID范围失败... %v", keyName, err)
 	}
 	var minId uint64 = 0
 	var maxId uint64 = 0
 	for rows.Next() {
 		err = rows.Scan(&maxId, &minId)
 		if err != nil || minId == 0 || maxId == 0 {
-			log.Panicf("[DB] 获取 %v ID范围失败... %v", d.rule.MainTable.MainCollName, err)
+			log.Panicf("[DB] 获取 %v ID范围失败... %v", keyName, err)
 		}
 	}
 	return minId, maxId
@@ -134,110 +318,429 @@ func (d *DB) buildModel() {
 		colls = append(colls, v)
 		collsBuilder = append(collsBuilder, fmt.Sprintf("`%v`.`%v`", d.rule.MainTable.TableName, v.CollName))
 	}
-	for _, table := range d.rule.JoinTables {
+	// 一对多的附表不参与 LEFT JOIN，查出主表数据后再单独查询并聚合为数组
+	var joinTables []*config.JoinTable
+	var manyTables []*config.JoinTable
+	for _, table := range d.rule.Subtree(nil) {
+		if table.Many {
+			manyTables = append(manyTables, table)
+		} else {
+			joinTables = append(joinTables, table)
+		}
+	}
+	for _, table := range joinTables {
 		for _, v := range table.CollList {
 			colls = append(colls, v)
 			collsBuilder = append(collsBuilder, fmt.Sprintf("`%v`.`%v`", table.TableName, v.CollName))
 		}
 	}
 	var fromBuilder = fmt.Sprintf("FROM `%v` ", d.rule.MainTable.TableName)
-	for _, table := range d.rule.JoinTables {
-		fromBuilder += fmt.Sprintf("LEFT JOIN `%v` ON `%v`.`%v` = `%v`.`%v` ", table.TableName, table.TableName, table.JoinCollName, d.rule.MainTable.TableName, table.MainCollName)
+	for _, table := range joinTables {
+		fromBuilder += d.joinClause("LEFT JOIN", table)
+	}
+	var keyColls []*config.Coll
+	for _, name := range d.rule.MainTable.KeyCollNames {
+		keyColls = append(keyColls, d.rule.MainTable.CollList[name])
 	}
 	d.colls = colls
-	d.rangeSearchModel = fmt.Sprintf("SELECT %v %v WHERE `%v`.`%v`", strings.Join(collsBuilder, ","), fromBuilder, d.rule.MainTable.TableName, d.rule.MainTable.MainCollName) + " BETWEEN %v AND %v"
-	d.idSearchModel = fmt.Sprintf("SELECT %v %v WHERE `%v`.`%v`", strings.Join(collsBuilder, ","), fromBuilder, d.rule.MainTable.TableName, d.rule.MainTable.MainCollName) + " in (%v)"
+	d.keyColls = keyColls
+	d.manyTables = manyTables
+	d.selectModel = fmt.Sprintf("SELECT %v %v", strings.Join(collsBuilder, ","), fromBuilder)
 }
 
-func (d *DB) FullGetByRange(startId uint64, endId uint64) []map[*config.Coll]interface{} {
-	if d.rangeSearchModel == "" {
-		d.buildModel()
+// joinClause 生成附表连接到上级表的 JOIN 子句，多级连接时上级表必须已经出现在 FROM 中
+func (d *DB) joinClause(join string, table *config.JoinTable) string {
+	return fmt.Sprintf("%v `%v` ON `%v`.`%v` = `%v`.`%v` ", join, table.TableName, table.TableName, table.JoinCollName, d.rule.ParentTableName(table), table.MainCollName)
+}
+
+// keyExpr 返回主键列表达式，联合主键为行构造器 (a, b)
+func (d *DB) keyExpr() string {
+	var names []string
+	for _, name := range d.rule.MainTable.KeyCollNames {
+		names = append(names, fmt.Sprintf("`%v`.`%v`", d.rule.MainTable.TableName, name))
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return "(" + strings.Join(names, ",") + ")"
+}
+
+// keyPlaceholder 返回一个主键对应的占位符，联合主键为 (?, ?)
+func (d *DB) keyPlaceholder() string {
+	n := len(d.rule.MainTable.KeyCollNames)
+	if n == 1 {
+		return "?"
+	}
+	return "(" + strings.TrimSuffix(strings.Repeat("?,", n), ",") + ")"
+}
+
+// Key 返回一行数据的主键值，按 KeyCollNames 顺序排列
+func (d *DB) Key(result map[*config.Coll]interface{}) []interface{} {
+	key := make([]interface{}, len(d.keyColls))
+	for i, coll := range d.keyColls {
+		key[i] = result[coll]
+	}
+	return key
+}
+
+// RowKey 返回 binlog 行中的主键值，按 KeyCollNames 顺序排列
+// 与查询结果一样经过 convert 转换（如 DATETIME、DECIMAL、二进制主键），保证生成的文档ID与全量同步一致
+func (d *DB) RowKey(table *schema.Table, row []interface{}) []interface{} {
+	key := make([]interface{}, len(d.rule.MainTable.KeyCollNames))
+	for i, name := range d.rule.MainTable.KeyCollNames {
+		index := table.FindColumn(name)
+		if index == -1 || index >= len(row) {
+			continue
+		}
+		key[i] = d.convertRowValue(d.rule.MainTable.CollList[name], &table.Columns[index], row[index])
+	}
+	return key
+}
+
+// keyArgs 将转换后的主键值还原为查询参数，日期时间在转换时改为了 ISO-8601 并可能带上时区
+func (d *DB) keyArgs(key []interface{}) []interface{} {
+	args := make([]interface{}, len(key))
+	for i, v := range key {
+		args[i] = v
+		str, ok := v.(string)
+		if !ok || i >= len(d.keyColls) {
+			continue
+		}
+		switch d.keyColls[i].CollType {
+		case DATETIME, TIMESTAMP:
+			t, err := time.Parse(time.RFC3339Nano, str)
+			if err != nil {
+				// 不带时区
+				args[i] = strings.Replace(str, "T", " ", 1)
+				continue
+			}
+			// TIMESTAMP 按会话时区 UTC 比较，DATETIME 取配置的时区中的字面值
+			if d.keyColls[i].CollType == TIMESTAMP || d.datetimeLoc == nil {
+				t = t.UTC()
+			} else {
+				t = t.In(d.datetimeLoc)
+			}
+			args[i] = t.Format("2006-01-02 15:04:05.999999")
+		}
 	}
-	execSQL := fmt.Sprintf(d.rangeSearchModel, startId, endId)
-	log.Info(execSQL)
-	rows, err := d.db.Query(execSQL)
+	return args
+}
+
+// fetch 执行查询并将每一行转换为 字段 -> 值
+func (d *DB) fetch(colls []*config.Coll, execSQL string, args ...interface{}) []map[*config.Coll]interface{} {
+	log.Infof("%v %v", execSQL, args)
+	rows, err := d.query(execSQL, args...)
 	if err != nil {
 		log.Panicf("%v 执行失败... %v", execSQL, err)
 	}
+	defer func() { _ = rows.Close() }()
 	var resultList []map[*config.Coll]interface{}
 	for rows.Next() {
-		params := GetParamsByColls(d.colls)
+		params := GetParamsByColls(colls)
 		err = rows.Scan(params...)
 		if err != nil {
-			// 忽略空异常
-			if !strings.Contains(err.Error(), "converting NULL") {
-				log.Panicf("%v 解析失败... %v", execSQL, err)
-			}
+			log.Panicf("%v 解析失败... %v", execSQL, err)
 		}
-		result := GetResultByParams(params, d.colls)
-		resultList = append(resultList, result)
+		resultList = append(resultList, d.GetResultByParams(params, colls))
+	}
+	if err = rows.Err(); err != nil {
+		log.Panicf("%v 读取失败... %v", execSQL, err)
 	}
 	return resultList
 }
 
-func (d *DB) FullGetById(ids []interface{}) []map[*config.Coll]interface{} {
-	if d.idSearchModel == "" {
+// fetchMain 查询主表宽表数据，并补齐一对多附表聚合的数组
+func (d *DB) fetchMain(execSQL string, args ...interface{}) []map[*config.Coll]interface{} {
+	resultList := d.fetch(d.colls, execSQL, args...)
+	for _, table := range d.manyTables {
+		d.fillMany(table, resultList)
+	}
+	return resultList
+}
+
+// fillMany 按主表的连接字段批量查询一对多附表，每个主表文档得到一个对象数组，没有匹配的行时为空数组
+func (d *DB) fillMany(table *config.JoinTable, resultList []map[*config.Coll]interface{}) {
+	mainColl := d.rule.MainTable.CollList[table.MainCollName]
+	var values []interface{}
+	seen := make(map[string]bool)
+	for _, result := range resultList {
+		v := result[mainColl]
+		if v == nil || seen[fmt.Sprintf("%v", v)] {
+			continue
+		}
+		seen[fmt.Sprintf("%v", v)] = true
+		values = append(values, v)
+	}
+	groups := make(map[string][]map[string]interface{})
+	for start := 0; start < len(values); start += maxInKeys {
+		end := start + maxInKeys
+		if end > len(values) {
+			end = len(values)
+		}
+		for joinValue, elements := range d.fetchMany(table, values[start:end]) {
+			groups[joinValue] = append(groups[joinValue], elements...)
+		}
+	}
+	for _, result := range resultList {
+		elements := groups[fmt.Sprintf("%v", result[mainColl])]
+		if elements == nil {
+			elements = []map[string]interface{}{}
+		}
+		result[table.ArrayColl] = elements
+	}
+}
+
+// fetchMany 查询连接字段在 values 中的附表数据，按连接字段分组
+func (d *DB) fetchMany(table *config.JoinTable, values []interface{}) map[string][]map[string]interface{} {
+	// 连接字段只用于分组，统一按字符串比较
+	joinColl := &config.Coll{CollName: table.JoinCollName, CollType: VARCHAR}
+	colls := []*config.Coll{joinColl}
+	names := []string{fmt.Sprintf("`%v`", table.JoinCollName)}
+	for _, coll := range table.CollList {
+		colls = append(colls, coll)
+		names = append(names, fmt.Sprintf("`%v`", coll.CollName))
+	}
+	size := inBucket(len(values))
+	args := make([]interface{}, size)
+	for i := range args {
+		if i < len(values) {
+			args[i] = values[i]
+		} else {
+			args[i] = values[len(values)-1]
+		}
+	}
+	execSQL := fmt.Sprintf("SELECT %v FROM `%v` WHERE `%v` IN (%v) ORDER BY `%v`",
+		strings.Join(names, ","), table.TableName, table.JoinCollName,
+		strings.TrimSuffix(strings.Repeat("?,", size), ","), table.JoinCollName)
+	groups := make(map[string][]map[string]interface{})
+	for _, result := range d.fetch(colls, execSQL, args...) {
+		element := make(map[string]interface{})
+		for coll, v := range result {
+			if coll != joinColl {
+				element[coll.MappingName] = v
+			}
+		}
+		joinValue := fmt.Sprintf("%v", result[joinColl])
+		groups[joinValue] = append(groups[joinValue], element)
+	}
+	return groups
+}
+
+func (d *DB) FullGetByRange(startId uint64, endId uint64) []map[*config.Coll]interface{} {
+	if d.selectModel == "" {
 		d.buildModel()
 	}
-	var idsStr []string
-	for _, id := range ids {
-		idsStr = append(idsStr, fmt.Sprintf("%v", id))
+	execSQL := d.selectModel + fmt.Sprintf("WHERE %v BETWEEN ? AND ?", d.keyExpr())
+	return d.fetchMain(execSQL, startId, endId)
+}
+
+// FullGetAfter 按主键顺序读取主键大于 lastKey 的 limit 条数据，lastKey 为空时从头读取
+// 返回本页最后一条的主键，没有数据时返回 false；联合主键使用行比较 (a, b) > (?, ?)
+// 与按ID范围读取相比，稀疏的ID空间不会产生大量空查询，也支持字符串主键
+func (d *DB) FullGetAfter(lastKey []interface{}, limit int) ([]map[*config.Coll]interface{}, []interface{}, bool) {
+	if d.selectModel == "" {
+		d.buildModel()
 	}
-	execSQL := fmt.Sprintf(d.idSearchModel, strings.Join(idsStr, ","))
-	log.Info(execSQL)
-	rows, err := d.db.Query(execSQL)
-	if err != nil {
-		log.Panicf("%v 执行失败... %v", execSQL, err)
+	keyExpr := d.keyExpr()
+	execSQL := d.selectModel
+	var args []interface{}
+	if lastKey != nil {
+		execSQL += fmt.Sprintf("WHERE %v > %v ", keyExpr, d.keyPlaceholder())
+		args = append(args, d.keyArgs(lastKey)...)
+	}
+	execSQL += fmt.Sprintf("ORDER BY %v LIMIT ?", strings.Trim(keyExpr, "()"))
+	args = append(args, limit)
+	resultList := d.fetchMain(execSQL, args...)
+	if len(resultList) == 0 {
+		return nil, lastKey, false
+	}
+	return resultList, d.Key(resultList[len(resultList)-1]), true
+}
+
+// FullGetById 按主键查询，keys 中每个元素为一个主键值列表
+// 主键较多时按 maxInKeys 拆分为多条查询，避免单条语句的占位符过多
+func (d *DB) FullGetById(keys [][]interface{}) []map[*config.Coll]interface{} {
+	if d.selectModel == "" {
+		d.buildModel()
 	}
 	var resultList []map[*config.Coll]interface{}
-	for rows.Next() {
-		params := GetParamsByColls(d.colls)
-		err = rows.Scan(params...)
-		if err != nil {
-			// 忽略空异常
-			if !strings.Contains(err.Error(), "converting NULL") {
-				log.Panicf("%v 解析失败... %v", execSQL, err)
-			}
+	for start := 0; start < len(keys); start += maxInKeys {
+		end := start + maxInKeys
+		if end > len(keys) {
+			end = len(keys)
 		}
-		result := GetResultByParams(params, d.colls)
-		resultList = append(resultList, result)
+		resultList = append(resultList, d.fetchByKeys(keys[start:end])...)
 	}
 	return resultList
 }
 
-func (d *DB) GetMainIdsByJoinId(joinId interface{}, joinTableName string) []interface{} {
-	mainFieldName := d.rule.JoinTables[joinTableName].MainCollName
-	execSQL := fmt.Sprintf("SELECT `%v` FROM `%v` WHERE `%v` = ",
-		d.rule.MainTable.MainCollName,
-		d.rule.MainTable.TableName,
-		mainFieldName)
-	if d.rule.MainTable.CollList[mainFieldName].CollType == VARCHAR ||
-		d.rule.MainTable.CollList[mainFieldName].CollType == TEXT {
-		execSQL += fmt.Sprintf(`"%v"`, joinId)
-	} else {
-		execSQL += fmt.Sprintf(`%v`, joinId)
+func (d *DB) fetchByKeys(keys [][]interface{}) []map[*config.Coll]interface{} {
+	size := inBucket(len(keys))
+	var args []interface{}
+	for i := 0; i < size; i++ {
+		if i < len(keys) {
+			args = append(args, d.keyArgs(keys[i])...)
+		} else {
+			args = append(args, d.keyArgs(keys[len(keys)-1])...)
+		}
 	}
-	log.Info(execSQL)
-	rows, err := d.db.Query(execSQL)
+	placeholders := strings.TrimSuffix(strings.Repeat(d.keyPlaceholder()+",", size), ",")
+	execSQL := d.selectModel + fmt.Sprintf("WHERE %v IN (%v)", d.keyExpr(), placeholders)
+	return d.fetchMain(execSQL, args...)
+}
+
+// GetMainIdsByJoinId 查询附表连接字段为 joinId 的主表主键
+// 多级连接时沿上级附表逐级连接到主表，条件落在附表的上级表上，被删除的附表行不影响查询
+func (d *DB) GetMainIdsByJoinId(joinId interface{}, joinTableName string) [][]interface{} {
+	if d.selectModel == "" {
+		d.buildModel()
+	}
+	joinTable := d.rule.JoinTables[joinTableName]
+	var names []string
+	for _, name := range d.rule.MainTable.KeyCollNames {
+		names = append(names, fmt.Sprintf("`%v`.`%v`", d.rule.MainTable.TableName, name))
+	}
+	fromBuilder := fmt.Sprintf("FROM `%v` ", d.rule.MainTable.TableName)
+	ancestors := d.rule.Ancestors(joinTable)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		fromBuilder += d.joinClause("INNER JOIN", ancestors[i])
+	}
+	execSQL := fmt.Sprintf("SELECT DISTINCT %v %vWHERE `%v`.`%v` = ?",
+		strings.Join(names, ","),
+		fromBuilder,
+		d.rule.ParentTableName(joinTable),
+		joinTable.MainCollName)
+	var keys [][]interface{}
+	for _, result := range d.fetch(d.keyColls, execSQL, joinId) {
+		keys = append(keys, d.Key(result))
+	}
+	return keys
+}
+
+// CheckRowImage binlog 为 ROW 格式并且记录完整行镜像时，才能直接使用 binlog 中的数据构建文档
+func (d *DB) CheckRowImage() (bool, string) {
+	var format, image string
+	err := d.db.QueryRow("SELECT @@GLOBAL.binlog_format, @@GLOBAL.binlog_row_image").Scan(&format, &image)
 	if err != nil {
-		log.Errorf("%v 执行失败... %v", execSQL, err)
-		return []interface{}{}
+		return false, err.Error()
 	}
-	colls := []*config.Coll{d.rule.MainTable.CollList[mainFieldName]}
-	var resultList []interface{}
-	for rows.Next() {
-		params := GetParamsByColls(colls)
-		err = rows.Scan(params...)
-		if err != nil {
-			// 忽略空异常
-			if !strings.Contains(err.Error(), "converting NULL") {
-				log.Panicf("%v 解析失败... %v", execSQL, err)
+	if !strings.EqualFold(format, "ROW") || !strings.EqualFold(image, "FULL") {
+		return false, fmt.Sprintf("binlog_format=%v binlog_row_image=%v", format, image)
+	}
+	return true, ""
+}
+
+// RowData 将 binlog 中的一行数据转换为 字段 -> 值，只包含 collList 中需要同步的字段
+func (d *DB) RowData(collList map[string]*config.Coll, table *schema.Table, row []interface{}) map[*config.Coll]interface{} {
+	result := make(map[*config.Coll]interface{})
+	for i, column := range table.Columns {
+		coll, e := collList[column.Name]
+		if !e || i >= len(row) {
+			continue
+		}
+		result[coll] = d.convertRowValue(coll, &table.Columns[i], row[i])
+	}
+	return result
+}
+
+// convertRowValue binlog 中 ENUM 为序号、SET 为位图，需要先还原为字符串
+func (d *DB) convertRowValue(coll *config.Coll, column *schema.TableColumn, v interface{}) interface{} {
+	switch coll.CollType {
+	case ENUM:
+		if n, ok := toInt64(v); ok {
+			if n <= 0 || int(n) > len(column.EnumValues) {
+				return ""
 			}
+			return column.EnumValues[n-1]
+		}
+	case SET:
+		if n, ok := toInt64(v); ok {
+			values := []string{}
+			for i, value := range column.SetValues {
+				if n&(1<<uint(i)) != 0 {
+					values = append(values, value)
+				}
+			}
+			return values
+		}
+	case DECIMAL:
+		// binlog 中的 decimal.Decimal 去掉了末尾的 0，按列定义的小数位数输出，与查询结果一致
+		if dec, ok := v.(decimal.Decimal); ok {
+			return d.convert(coll.CollType, dec.StringFixed(decimalScale(column.RawType)))
+		}
+	case BINARY:
+		// binlog 中定长的 BINARY 去掉了末尾补齐的 0x00，查询结果中是补齐的
+		if str, ok := v.(string); ok && column.FixedSize > 0 && uint(len(str)) < column.FixedSize {
+			return d.convert(coll.CollType, str+strings.Repeat("\x00", int(column.FixedSize)-len(str)))
 		}
-		result := GetResultByParams(params, colls)
-		resultList = append(resultList, result[d.rule.MainTable.CollList[mainFieldName]])
 	}
-	return resultList
+	return d.convert(coll.CollType, v)
+}
+
+// decimalScale 从 decimal(10,2) 这样的列定义中取出小数位数
+func decimalScale(rawType string) int32 {
+	start := strings.Index(rawType, ",")
+	end := strings.Index(rawType, ")")
+	if start == -1 || end < start {
+		return 0
+	}
+	return int32(utils.Str2Int(strings.TrimSpace(rawType[start+1 : end])))
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int32:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// GetJoinData 查询附表中连接字段为 joinValue 的数据，包括以该附表为上级的所有下级附表
+// 未匹配到时所有字段为 nil，与 LEFT JOIN 的结果一致；一对多的附表返回聚合后的数组
+func (d *DB) GetJoinData(joinTable *config.JoinTable, joinValue interface{}) map[*config.Coll]interface{} {
+	// 一对多的附表返回连接字段为 joinValue 的全部行聚合成的数组
+	if joinTable.Many {
+		elements := []map[string]interface{}{}
+		if joinValue != nil {
+			for _, group := range d.fetchMany(joinTable, []interface{}{joinValue}) {
+				elements = append(elements, group...)
+			}
+		}
+		return map[*config.Coll]interface{}{joinTable.ArrayColl: elements}
+	}
+	var colls []*config.Coll
+	var names []string
+	fromBuilder := fmt.Sprintf("FROM `%v` ", joinTable.TableName)
+	for i, table := range d.rule.Subtree(joinTable) {
+		for _, coll := range table.CollList {
+			colls = append(colls, coll)
+			names = append(names, fmt.Sprintf("`%v`.`%v`", table.TableName, coll.CollName))
+		}
+		if i > 0 {
+			fromBuilder += d.joinClause("LEFT JOIN", table)
+		}
+	}
+	result := make(map[*config.Coll]interface{})
+	for _, coll := range colls {
+		result[coll] = nil
+	}
+	if joinValue == nil || len(colls) == 0 {
+		return result
+	}
+	execSQL := fmt.Sprintf("SELECT %v %vWHERE `%v`.`%v` = ? LIMIT 1", strings.Join(names, ","), fromBuilder, joinTable.TableName, joinTable.JoinCollName)
+	resultList := d.fetch(colls, execSQL, joinValue)
+	if len(resultList) > 0 {
+		result = resultList[0]
+	}
+	return result
 }
 
 func (d *DB) GetOldestBinlogName() string {
@@ -259,60 +762,282 @@ func (d *DB) GetOldestBinlogName() string {
 	return ""
 }
 
-func GetResultByParams(params []interface{}, colls []*config.Coll) map[*config.Coll]interface{} {
+// GetMasterPosition 返回当前 binlog 写入位点
+func (d *DB) GetMasterPosition() (string, uint32) {
+	rows, err := d.db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		log.Panicf("[DB] 获取BINLOG位点失败... %v", err)
+	}
+	defer func() { _ = rows.Close() }()
+	return scanMasterStatus(rows)
+}
+
+// scanMasterStatus SHOW MASTER STATUS 在不同版本中列数不同，只取前两列
+func scanMasterStatus(rows *sql.Rows) (string, uint32) {
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Panicf("[DB] 获取BINLOG位点失败... %v", err)
+	}
+	if !rows.Next() {
+		log.Panic("[DB] 获取BINLOG位点失败，请确认已开启binlog")
+	}
+	var name string
+	var pos uint32
+	params := []interface{}{&name, &pos}
+	for i := 2; i < len(columns); i++ {
+		var temp interface{}
+		params = append(params, &temp)
+	}
+	err = rows.Scan(params...)
+	if err != nil {
+		log.Panicf("[DB] 获取BINLOG位点失败... %v", err)
+	}
+	return name, pos
+}
+
+// GetResultByParams 将扫描结果转换为写入ES的值，SQL NULL（包括 LEFT JOIN 未匹配到的附表字段）转换为 nil
+func (d *DB) GetResultByParams(params []interface{}, colls []*config.Coll) map[*config.Coll]interface{} {
 	result := make(map[*config.Coll]interface{})
 	for i, v := range params {
-		switch colls[i].CollType {
-		case INT, BIGINT, TINYINT, SmallInt:
-			result[colls[i]] = *(v.(*int64))
-		case VARCHAR, TEXT:
-			result[colls[i]] = *(v.(*string))
-		case UnsignedBigint, UnsignedSmallInt:
-			result[colls[i]] = *(v.(*uint64))
-		}
+		result[colls[i]] = d.convert(colls[i].CollType, *(v.(*interface{})))
 	}
 	return result
 }
 
-func GetParamsByColls(colls []*config.Coll) []interface{} {
-	var params []interface{}
-	for _, coll := range colls {
-		switch coll.CollType {
-		case INT, BIGINT, TINYINT, SmallInt:
-			var arg int64
-			params = append(params, &arg)
-		case VARCHAR, TEXT:
-			var arg string
-			params = append(params, &arg)
-		case UnsignedBigint, UnsignedSmallInt:
-			var arg uint64
-			params = append(params, &arg)
+// convert 将驱动返回的原始值转换为写入ES的值
+// 驱动根据查询方式不同可能返回 []byte、数字或 time.Time，这里统一处理
+func (d *DB) convert(collType uint8, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if t, ok := v.(time.Time); ok {
+		return d.formatTime(collType, t)
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		b = []byte(fmt.Sprintf("%v", v))
+	}
+	str := string(b)
+	switch collType {
+	case INT, BIGINT, TINYINT, SmallInt, MediumInt:
+		if n, ok := v.(int64); ok {
+			return n
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			log.Errorf("[DB] 解析整数 %v 失败... %v", str, err)
+			return nil
+		}
+		return n
+	case UnsignedBigint, UnsignedSmallInt:
+		if n, ok := v.(uint64); ok {
+			return n
+		}
+		n, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			log.Errorf("[DB] 解析整数 %v 失败... %v", str, err)
+			return nil
+		}
+		return n
+	case FLOAT, DOUBLE:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			log.Errorf("[DB] 解析浮点数 %v 失败... %v", str, err)
+			return nil
 		}
+		return f
+	case DECIMAL:
+		// 默认以字符串写入，避免精度丢失；json.Number 原样输出为数字
+		if d.decimalAsNumber {
+			return json.Number(str)
+		}
+		return str
+	case YEAR:
+		return int64(utils.Str2Int(str))
+	case DATE, DATETIME, TIMESTAMP:
+		// 0000-00-00 这类零值无法被ES解析
+		if strings.HasPrefix(str, "0000-00-00") {
+			return nil
+		}
+		// ISO-8601，会话时区与 binlog 解析都使用 UTC，TIMESTAMP 带上 Z；DATETIME 配置了时区时带上偏移，否则由ES按 UTC 处理
+		switch {
+		case collType == TIMESTAMP:
+			return strings.Replace(str, " ", "T", 1) + "Z"
+		case collType == DATETIME && d.datetimeLoc != nil:
+			t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", str, d.datetimeLoc)
+			if err != nil {
+				log.Errorf("[DB] 解析时间 %v 失败... %v", str, err)
+				return nil
+			}
+			return t.Format("2006-01-02T15:04:05.999999Z07:00")
+		}
+		return strings.Replace(str, " ", "T", 1)
+	case SET:
+		if str == "" {
+			return []string{}
+		}
+		return strings.Split(str, ",")
+	case JSON:
+		var obj interface{}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		err := decoder.Decode(&obj)
+		if err != nil {
+			log.Errorf("[DB] 解析JSON %v 失败... %v", str, err)
+			return nil
+		}
+		return obj
+	case BIT:
+		if !ok {
+			return v
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n
+	case BLOB, BINARY:
+		// []byte 序列化为 base64，对应ES的 binary 类型
+		return b
+	case GEOMETRY:
+		shape, err := geoJSON(b)
+		if err != nil {
+			log.Errorf("[DB] 解析空间数据失败... %v", err)
+			return nil
+		}
+		return shape
+	default:
+		return str
 	}
-	if params == nil {
-		params = []interface{}{}
+}
+
+func (d *DB) formatTime(collType uint8, t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	switch collType {
+	case DATE:
+		return t.Format("2006-01-02")
+	case YEAR:
+		return int64(t.Year())
+	case TIMESTAMP:
+		return t.UTC().Format("2006-01-02T15:04:05.999999Z07:00")
+	case DATETIME:
+		if d.datetimeLoc != nil {
+			// 驱动按 UTC 构造不带时区的 DATETIME，取出字面值放到配置的时区中
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), d.datetimeLoc)
+			return t.Format("2006-01-02T15:04:05.999999Z07:00")
+		}
+		return t.Format("2006-01-02T15:04:05.999999")
+	default:
+		return t.Format("2006-01-02T15:04:05.999999")
+	}
+}
+
+// GetParamsByColls 所有列都扫描到 interface{} 中，NULL 扫描为 nil，由 GetResultByParams 按列类型转换
+func GetParamsByColls(colls []*config.Coll) []interface{} {
+	params := make([]interface{}, len(colls))
+	for i := range colls {
+		var arg interface{}
+		params[i] = &arg
 	}
 	return params
 }
 
+// GetCollTypeFromMysql 解析 DESC 返回的列类型，兼容 MySQL 8 中不带显示宽度的整数类型（如 int unsigned）
 func GetCollTypeFromMysql(t string) uint8 {
-	if strings.HasPrefix(t, "int(") {
+	t = strings.ToLower(t)
+	unsigned := strings.Contains(t, "unsigned")
+	base := t
+	if i := strings.IndexAny(base, "( "); i != -1 {
+		base = base[:i]
+	}
+	switch base {
+	case "int", "integer":
 		return INT
-	} else if strings.HasPrefix(t, "tinyint(") {
+	case "tinyint", "bool", "boolean":
 		return TINYINT
-	} else if strings.HasPrefix(t, "bigint(") && strings.HasSuffix(t, "unsigned") {
-		return UnsignedBigint
-	} else if strings.HasPrefix(t, "bigint(") {
+	case "smallint":
+		if unsigned {
+			return UnsignedSmallInt
+		}
+		return SmallInt
+	case "mediumint":
+		return MediumInt
+	case "bigint":
+		if unsigned {
+			return UnsignedBigint
+		}
 		return BIGINT
-	} else if strings.HasPrefix(t, "varchar(") {
+	case "float":
+		return FLOAT
+	case "double", "real":
+		return DOUBLE
+	case "decimal", "numeric":
+		return DECIMAL
+	case "date":
+		return DATE
+	case "datetime":
+		return DATETIME
+	case "timestamp":
+		return TIMESTAMP
+	case "time":
+		return TIME
+	case "year":
+		return YEAR
+	case "varchar":
 		return VARCHAR
-	} else if strings.Contains(t, "text") {
+	case "char":
+		return CHAR
+	case "tinytext", "text", "mediumtext", "longtext":
 		return TEXT
-	} else if strings.HasPrefix(t, "smallint(") && strings.HasSuffix(t, "unsigned") {
-		return UnsignedSmallInt
-	} else if strings.HasPrefix(t, "smallint(") {
-		return SmallInt
-	} else {
+	case "json":
+		return JSON
+	case "enum":
+		return ENUM
+	case "set":
+		return SET
+	case "bit":
+		return BIT
+	case "tinyblob", "blob", "mediumblob", "longblob":
+		return BLOB
+	case "binary", "varbinary":
+		return BINARY
+	case "geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon",
+		"geometrycollection", "geomcollection":
+		return GEOMETRY
+	default:
 		return Unknown
 	}
 }
+
+// GetEsType 返回MySQL类型对应的默认ES字段类型
+func GetEsType(collType uint8) string {
+	switch collType {
+	case INT, BIGINT, MediumInt, BIT:
+		return "long"
+	case UnsignedBigint:
+		// 大于 2^63-1 的值超出 long 的范围，ES 7.10 以下不支持 unsigned_long 时由ES客户端改为 keyword
+		return "unsigned_long"
+	case TINYINT, SmallInt, UnsignedSmallInt, YEAR:
+		return "integer"
+	case FLOAT:
+		return "float"
+	case DOUBLE, DECIMAL:
+		// 以字符串写入的 DECIMAL 会被ES转换为数字索引，_source 中仍保留原始精度
+		return "double"
+	case DATE, DATETIME, TIMESTAMP:
+		return "date"
+	case VARCHAR, CHAR, ENUM, SET, TIME:
+		return "keyword"
+	case TEXT:
+		return "text"
+	case BLOB, BINARY:
+		return "binary"
+	case GEOMETRY:
+		return "geo_shape"
+	default:
+		// JSON 列的结构不固定，由ES动态映射
+		return ""
+	}
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"go-mysql2es/src/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func keyRule(types ...uint8) (*config.Rule, []*config.Coll, *schema.Table) {
+	names := []string{"a", "b", "c", "d"}[:len(types)]
+	main := &config.MainTable{TableName: "t", CollList: map[string]*config.Coll{}, KeyCollNames: names}
+	table := &schema.Table{Name: "t"}
+	var colls []*config.Coll
+	for i, name := range names {
+		coll := &config.Coll{CollName: name, MappingName: name, CollType: types[i]}
+		main.CollList[name] = coll
+		colls = append(colls, coll)
+		table.Columns = append(table.Columns, schema.TableColumn{Name: name})
+	}
+	return &config.Rule{MainTable: main}, colls, table
+}
+
+func TestRowKeyMatchesQueryConversion(t *testing.T) {
+	rule, colls, table := keyRule(DATETIME, TIMESTAMP, DECIMAL, BINARY)
+	table.Columns[2].RawType = "decimal(10,2)"
+	table.Columns[3].FixedSize = 4
+	d := &DB{rule: rule, keyColls: colls}
+	// binlog 中的原始值
+	row := []interface{}{"2021-01-02 15:04:05", "2021-01-02 15:04:05.5", decimal.RequireFromString("1.50"), "ab"}
+	// 查询结果中的原始值
+	result := []interface{}{[]byte("2021-01-02 15:04:05"), []byte("2021-01-02 15:04:05.5"), []byte("1.50"), []byte("ab\x00\x00")}
+	key := d.RowKey(table, row)
+	var want []interface{}
+	for i, coll := range colls {
+		want = append(want, d.convert(coll.CollType, result[i]))
+	}
+	if !reflect.DeepEqual(key, want) {
+		t.Fatalf("key = %#v, want %#v", key, want)
+	}
+	if rule.MainTable.DocId(key[2:3]) != "1.50" {
+		t.Fatalf("decimal doc id = %v, want 1.50", rule.MainTable.DocId(key[2:3]))
+	}
+}
+
+func TestKeyArgs(t *testing.T) {
+	rule, colls, table := keyRule(DATETIME, TIMESTAMP, INT)
+	d := &DB{rule: rule, keyColls: colls, datetimeLoc: time.FixedZone("CST", 8*3600)}
+	key := d.RowKey(table, []interface{}{"2021-01-02 15:04:05", "2021-01-02 07:04:05.123", int64(1)})
+	if !reflect.DeepEqual(key, []interface{}{"2021-01-02T15:04:05+08:00", "2021-01-02T07:04:05.123Z", int64(1)}) {
+		t.Fatalf("key = %#v", key)
+	}
+	// 查询参数还原为 MySQL 中的字面值
+	args := d.keyArgs(key)
+	want := []interface{}{"2021-01-02 15:04:05", "2021-01-02 07:04:05.123", int64(1)}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("args = %#v, want %#v", args, want)
+	}
+
+	d.datetimeLoc = nil
+	args = d.keyArgs([]interface{}{"2021-01-02T15:04:05", "2021-01-02T07:04:05Z", int64(1)})
+	want = []interface{}{"2021-01-02 15:04:05", "2021-01-02 07:04:05", int64(1)}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("args = %#v, want %#v", args, want)
+	}
+}
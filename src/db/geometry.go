@@ -0,0 +1,165 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errShortGeometry = errors.New("空间数据长度不足")
+
+// WKB 中的几何类型
+var geometryTypes = map[uint32]string{
+	1: "Point",
+	2: "LineString",
+	3: "Polygon",
+	4: "MultiPoint",
+	5: "MultiLineString",
+	6: "MultiPolygon",
+	7: "GeometryCollection",
+}
+
+// geoJSON 将MySQL的空间数据转换为 GeoJSON，对应ES的 geo_shape 类型
+// MySQL 内部格式为 4 字节 SRID 加 WKB，坐标按 经度、纬度 的顺序存储
+func geoJSON(b []byte) (map[string]interface{}, error) {
+	if len(b) < 4 {
+		return nil, errShortGeometry
+	}
+	r := &wkbReader{data: b[4:]}
+	shape, err := r.geometry()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("空间数据末尾有 %v 字节多余数据", len(r.data))
+	}
+	return shape, nil
+}
+
+type wkbReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) geometry() (map[string]interface{}, error) {
+	if len(r.data) < 1 {
+		return nil, errShortGeometry
+	}
+	switch r.data[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("无法识别的字节序 %v", r.data[0])
+	}
+	r.data = r.data[1:]
+	t, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := geometryTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("无法识别的几何类型 %v", t)
+	}
+	shape := map[string]interface{}{"type": name}
+	var coordinates interface{}
+	switch t {
+	case 1:
+		coordinates, err = r.point()
+	case 2:
+		coordinates, err = r.points()
+	case 3:
+		coordinates, err = r.rings()
+	default:
+		n, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		// 每个子几何至少有 1 字节字节序与 4 字节类型
+		if uint64(n)*5 > uint64(len(r.data)) {
+			return nil, errShortGeometry
+		}
+		parts := make([]interface{}, 0, n)
+		for i := uint32(0); i < n; i++ {
+			part, err := r.geometry()
+			if err != nil {
+				return nil, err
+			}
+			if t == 7 {
+				parts = append(parts, part)
+			} else {
+				parts = append(parts, part["coordinates"])
+			}
+		}
+		if t == 7 {
+			shape["geometries"] = parts
+			return shape, nil
+		}
+		coordinates = parts
+	}
+	if err != nil {
+		return nil, err
+	}
+	shape["coordinates"] = coordinates
+	return shape, nil
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errShortGeometry
+	}
+	n := r.order.Uint32(r.data)
+	r.data = r.data[4:]
+	return n, nil
+}
+
+func (r *wkbReader) point() ([]float64, error) {
+	if len(r.data) < 16 {
+		return nil, errShortGeometry
+	}
+	x := math.Float64frombits(r.order.Uint64(r.data))
+	y := math.Float64frombits(r.order.Uint64(r.data[8:]))
+	r.data = r.data[16:]
+	return []float64{x, y}, nil
+}
+
+func (r *wkbReader) points() ([][]float64, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n)*16 > uint64(len(r.data)) {
+		return nil, errShortGeometry
+	}
+	points := make([][]float64, 0, n)
+	for i := uint32(0); i < n; i++ {
+		p, err := r.point()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func (r *wkbReader) rings() ([][][]float64, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	// 每个环至少有 4 字节的点数
+	if uint64(n)*4 > uint64(len(r.data)) {
+		return nil, errShortGeometry
+	}
+	rings := make([][][]float64, 0, n)
+	for i := uint32(0); i < n; i++ {
+		ring, err := r.points()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, ring)
+	}
+	return rings, nil
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// wkbWriter 按指定字节序构造 WKB 测试数据
+type wkbWriter struct {
+	order binary.ByteOrder
+	data  []byte
+}
+
+func (w *wkbWriter) header(t uint32) *wkbWriter {
+	if w.order == binary.BigEndian {
+		w.data = append(w.data, 0)
+	} else {
+		w.data = append(w.data, 1)
+	}
+	return w.uint32(t)
+}
+
+func (w *wkbWriter) uint32(n uint32) *wkbWriter {
+	b := make([]byte, 4)
+	w.order.PutUint32(b, n)
+	w.data = append(w.data, b...)
+	return w
+}
+
+func (w *wkbWriter) point(x, y float64) *wkbWriter {
+	b := make([]byte, 16)
+	w.order.PutUint64(b, math.Float64bits(x))
+	w.order.PutUint64(b[8:], math.Float64bits(y))
+	w.data = append(w.data, b...)
+	return w
+}
+
+func (w *wkbWriter) points(ps ...[2]float64) *wkbWriter {
+	w.uint32(uint32(len(ps)))
+	for _, p := range ps {
+		w.point(p[0], p[1])
+	}
+	return w
+}
+
+// mysql 在 WKB 前面加上 4 字节 SRID
+func (w *wkbWriter) bytes() []byte {
+	return append([]byte{0, 0, 0, 0}, w.data...)
+}
+
+var geometryCases = []struct {
+	name  string
+	build func(w *wkbWriter)
+	want  string
+}{
+	{"Point", func(w *wkbWriter) {
+		w.header(1).point(116.4, 39.9)
+	}, `{"coordinates":[116.4,39.9],"type":"Point"}`},
+	{"LineString", func(w *wkbWriter) {
+		w.header(2).points([2]float64{1, 2}, [2]float64{3, 4})
+	}, `{"coordinates":[[1,2],[3,4]],"type":"LineString"}`},
+	{"Polygon", func(w *wkbWriter) {
+		w.header(3).uint32(2).
+			points([2]float64{0, 0}, [2]float64{10, 0}, [2]float64{10, 10}, [2]float64{0, 0}).
+			points([2]float64{1, 1}, [2]float64{2, 1}, [2]float64{2, 2}, [2]float64{1, 1})
+	}, `{"coordinates":[[[0,0],[10,0],[10,10],[0,0]],[[1,1],[2,1],[2,2],[1,1]]],"type":"Polygon"}`},
+	{"MultiPoint", func(w *wkbWriter) {
+		w.header(4).uint32(2)
+		w.header(1).point(1, 2)
+		w.header(1).point(3, 4)
+	}, `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+	{"MultiLineString", func(w *wkbWriter) {
+		w.header(5).uint32(2)
+		w.header(2).points([2]float64{1, 2}, [2]float64{3, 4})
+		w.header(2).points([2]float64{5, 6}, [2]float64{7, 8})
+	}, `{"coordinates":[[[1,2],[3,4]],[[5,6],[7,8]]],"type":"MultiLineString"}`},
+	{"MultiPolygon", func(w *wkbWriter) {
+		w.header(6).uint32(1)
+		w.header(3).uint32(1).points([2]float64{0, 0}, [2]float64{1, 0}, [2]float64{1, 1}, [2]float64{0, 0})
+	}, `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]],"type":"MultiPolygon"}`},
+	{"GeometryCollection", func(w *wkbWriter) {
+		w.header(7).uint32(2)
+		w.header(1).point(1, 2)
+		w.header(2).points([2]float64{3, 4}, [2]float64{5, 6})
+	}, `{"geometries":[{"coordinates":[1,2],"type":"Point"},{"coordinates":[[3,4],[5,6]],"type":"LineString"}],"type":"GeometryCollection"}`},
+}
+
+func TestGeoJSON(t *testing.T) {
+	orders := map[string]binary.ByteOrder{"little": binary.LittleEndian, "big": binary.BigEndian}
+	for orderName, order := range orders {
+		for _, c := range geometryCases {
+			w := &wkbWriter{order: order}
+			c.build(w)
+			shape, err := geoJSON(w.bytes())
+			if err != nil {
+				t.Fatalf("%v %v: %v", c.name, orderName, err)
+			}
+			got, _ := json.Marshal(shape)
+			if string(got) != c.want {
+				t.Fatalf("%v %v: got %s, want %s", c.name, orderName, got, c.want)
+			}
+		}
+	}
+}
+
+func TestGeoJSONTruncated(t *testing.T) {
+	for _, c := range geometryCases {
+		w := &wkbWriter{order: binary.LittleEndian}
+		c.build(w)
+		b := w.bytes()
+		// 截断在任意位置都应返回错误，而不是 panic
+		for i := 0; i < len(b); i++ {
+			if _, err := geoJSON(b[:i]); err == nil {
+				t.Fatalf("%v truncated to %v bytes: want error", c.name, i)
+			}
+		}
+	}
+}
+
+func TestGeoJSONInvalid(t *testing.T) {
+	cases := map[string][]byte{
+		// 声明了大量子几何但没有数据
+		"huge collection": (&wkbWriter{order: binary.LittleEndian}).header(7).uint32(math.MaxUint32).bytes(),
+		"huge polygon":    (&wkbWriter{order: binary.LittleEndian}).header(3).uint32(math.MaxUint32).bytes(),
+		"huge linestring": (&wkbWriter{order: binary.LittleEndian}).header(2).uint32(math.MaxUint32).bytes(),
+		"bad byte order":  {0, 0, 0, 0, 2, 1, 0, 0, 0},
+		"bad type":        (&wkbWriter{order: binary.LittleEndian}).header(99).bytes(),
+		"trailing bytes":  append((&wkbWriter{order: binary.LittleEndian}).header(1).point(1, 2).bytes(), 0),
+	}
+	for name, b := range cases {
+		if _, err := geoJSON(b); err == nil {
+			t.Fatalf("%v: want error", name)
+		}
+	}
+}
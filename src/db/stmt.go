@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// 一条 IN 查询最多携带的主键数量，超过时拆分为多条查询
+const maxInKeys = 512
+
+// stmtCache 按 SQL 缓存预编译语句，同一形状的查询只编译一次
+// 快照中的语句绑定在快照连接上，每个快照各自缓存，结束快照时关闭
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *stmtCache) get(query string, prepare func(query string) (*sql.Stmt, error)) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stmt, e := c.stmts[query]
+	if e {
+		return stmt, nil
+	}
+	stmt, err := prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, stmt := range c.stmts {
+		_ = stmt.Close()
+		delete(c.stmts, query)
+	}
+}
+
+// prepare 在快照中时在快照连接上编译，否则在连接池上编译，database/sql 会在需要时自动在其他连接上重新编译
+func (d *DB) prepare(query string) (*sql.Stmt, error) {
+	return d.stmts.get(query, func(query string) (*sql.Stmt, error) {
+		if d.conn != nil {
+			return d.conn.PrepareContext(context.Background(), query)
+		}
+		return d.db.Prepare(query)
+	})
+}
+
+// inBucket IN 列表的长度向上取整到 2 的幂，不足的部分重复最后一个主键补齐，
+// 这样不同数量的主键只会产生有限几种语句形状
+func inBucket(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
@@ -0,0 +1,88 @@
+package dlq
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const ActionIndex = "index"
+
+const ActionDelete = "delete"
+
+// ActionUpdate 局部更新，Doc 中只有需要更新的字段
+const ActionUpdate = "update"
+
+// Record 死信文件中的一行，记录无法写入ES的文档以及失败原因
+type Record struct {
+	Id     string                 `json:"id"`
+	Action string                 `json:"action"`
+	Doc    map[string]interface{} `json:"doc,omitempty"`
+	// 局部更新时文档不存在是否以 Doc 创建
+	Upsert   bool   `json:"upsert,omitempty"`
+	BinLog   string `json:"binlog,omitempty"`
+	Position uint32 `json:"position,omitempty"`
+	Error    string `json:"error"`
+	Time     string `json:"time"`
+}
+
+// Writer 以 NDJSON 格式追加写入死信文件
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func New(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: f}, nil
+}
+
+func (w *Writer) Write(r *Record) error {
+	if r.Time == "" {
+		r.Time = time.Now().Format(time.RFC3339)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *Writer) Close() error {
+	return w.file.Close()
+}
+
+// Read 读取死信文件中的全部记录
+func Read(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := &Record{}
+		err = json.Unmarshal(scanner.Bytes(), r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
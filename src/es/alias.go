@@ -0,0 +1,91 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+)
+
+// IndexName 返回当前写入的索引名
+func (c *Client) IndexName() string {
+	return c.conf.Index
+}
+
+// WithIndex 返回写入另一个索引的客户端，与原客户端共享连接、节点与熔断状态
+func (c *Client) WithIndex(index string) *Client {
+	conf := *c.conf
+	conf.Index = index
+	client := *c
+	client.conf = &conf
+	return &client
+}
+
+func (c *Client) IndexExists(index string) (bool, error) {
+	status, _, err := c.do("HEAD", "/"+index, nil, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusNotFound, nil
+}
+
+// AliasIndices 返回别名指向的索引，别名不存在时返回空
+func (c *Client) AliasIndices(alias string) ([]string, error) {
+	status, body, err := c.do("GET", "/_alias/"+alias, nil, http.StatusNotFound)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, fmt.Errorf("[ES] 解析别名 %v 失败 %v: %v", alias, err, string(body))
+	}
+	var indices []string
+	for index := range m {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// SwapAlias 原子地将别名从旧索引切换到新索引
+// removeIndex 为 true 时表示旧的同名索引本身就是别名名称，需要在同一个请求中删除该索引后才能创建别名
+// remove_index 需要 ES 6.4 及以上，更早的版本先删除同名索引再创建别名，两次请求之间别名不可查询
+func (c *Client) SwapAlias(alias string, index string, oldIndices []string, removeIndex bool) error {
+	var actions []map[string]interface{}
+	if removeIndex {
+		if c.removeIndex {
+			actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": alias}})
+		} else {
+			log.Warnf("[ES] 当前版本不支持 remove_index，先删除索引 %v 再创建别名，切换期间 %v 不可查询", alias, alias)
+			err := c.DeleteIndex(alias)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, old := range oldIndices {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": alias}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": index, "alias": alias}})
+	data, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("POST", "/_aliases", data)
+	if err != nil {
+		return err
+	}
+	log.Infof("[ES] 别名 %v 切换 %v -> %v", alias, oldIndices, index)
+	return nil
+}
+
+func (c *Client) DeleteIndex(index string) error {
+	_, _, err := c.do("DELETE", "/"+index, nil, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	log.Infof("[ES] 删除索引 %v", index)
+	return nil
+}
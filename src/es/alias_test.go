@@ -0,0 +1,68 @@
+package es
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordServer 记录收到的请求，全部返回 200
+type recordServer struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *recordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+	s.mu.Unlock()
+	_, _ = w.Write([]byte(`{"acknowledged":true}`))
+}
+
+func TestSwapAliasRemoveIndex(t *testing.T) {
+	s := &recordServer{}
+	c := newTestClient(t, s, 1, false)
+	if !c.removeIndex {
+		t.Fatal("7.10 should support remove_index")
+	}
+	if err := c.SwapAlias("test", "test_v2", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	want := `POST /_aliases {"actions":[{"remove_index":{"index":"test"}},{"add":{"alias":"test","index":"test_v2"}}]}`
+	if len(s.requests) != 1 || s.requests[0] != want {
+		t.Fatalf("requests = %v, want %v", s.requests, want)
+	}
+}
+
+func TestSwapAliasWithoutRemoveIndex(t *testing.T) {
+	s := &recordServer{}
+	c := newTestClient(t, s, 1, false)
+	// ES 6.4 以下先删除同名索引
+	c.removeIndex = false
+	if err := c.SwapAlias("test", "test_v2", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`DELETE /test`,
+		`POST /_aliases {"actions":[{"add":{"alias":"test","index":"test_v2"}}]}`,
+	}
+	if strings.Join(s.requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("requests = %v, want %v", s.requests, want)
+	}
+}
+
+func TestSwapAliasOldIndices(t *testing.T) {
+	s := &recordServer{}
+	c := newTestClient(t, s, 1, false)
+	c.removeIndex = false
+	if err := c.SwapAlias("test", "test_v3", []string{"test_v2"}, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `POST /_aliases {"actions":[{"remove":{"alias":"test","index":"test_v2"}},{"add":{"alias":"test","index":"test_v3"}}]}`
+	if len(s.requests) != 1 || s.requests[0] != want {
+		t.Fatalf("requests = %v, want %v", s.requests, want)
+	}
+}
@@ -0,0 +1,52 @@
+package es
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go-mysql2es/src/config"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// newHttpClient 按配置设置请求超时，构建 https 所需的证书
+func newHttpClient(conf *config.ESConf) (*http.Client, error) {
+	timeout := time.Duration(conf.RequestTimeoutMs) * time.Millisecond
+	if conf.Scheme != "https" {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CaFile != "" {
+		ca, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("[ES] 解析CA证书 %v 失败", conf.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// authorize 为每个请求加上认证信息
+func (c *Client) authorize(req *http.Request) {
+	if c.conf.ApiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.conf.ApiKey)
+	} else if c.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.conf.BearerToken)
+	} else if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+}
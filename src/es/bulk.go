@@ -0,0 +1,286 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/config"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OpIndex = "index"
+
+const OpUpdate = "update"
+
+const OpDelete = "delete"
+
+// Action bulk 请求中的一个操作
+type Action struct {
+	Op  string
+	Id  interface{}
+	Doc map[string]interface{}
+	// update 时文档不存在则以 Doc 创建
+	Upsert  bool
+	encoded string
+}
+
+// encode 转换为 bulk 请求中的一到两行
+func (a *Action) encode() (string, error) {
+	if a.encoded != "" {
+		return a.encoded, nil
+	}
+	line, err := a.marshal()
+	if err == nil {
+		a.encoded = line
+	}
+	return line, err
+}
+
+func (a *Action) marshal() (string, error) {
+	id, err := json.Marshal(fmt.Sprintf("%v", a.Id))
+	if err != nil {
+		return "", err
+	}
+	meta := fmt.Sprintf(`{"%v":{"_id":%v}}`, a.Op, string(id))
+	switch a.Op {
+	case OpDelete:
+		return meta, nil
+	case OpUpdate:
+		body, err := json.Marshal(map[string]interface{}{"doc": a.Doc, "doc_as_upsert": a.Upsert})
+		if err != nil {
+			return "", err
+		}
+		return meta + "\n" + string(body), nil
+	default:
+		body, err := json.Marshal(a.Doc)
+		if err != nil {
+			return "", err
+		}
+		return meta + "\n" + string(body), nil
+	}
+}
+
+// IndexAction 将一行数据转换为覆盖写入的操作，文档中带上 id 字段
+func (c *Client) IndexAction(data map[*config.Coll]interface{}) *Action {
+	id, doc := c.Doc(data)
+	doc["id"] = id
+	return &Action{Op: OpIndex, Id: id, Doc: doc}
+}
+
+// UpdateAction 将部分字段转换为局部更新的操作，文档不存在时以这些字段创建
+// 局部更新不会删除文档中已有的字段，因此值为 NULL 的字段总是写入 null
+func (c *Client) UpdateAction(data map[*config.Coll]interface{}) *Action {
+	id, doc := c.Doc(data)
+	for k, v := range data {
+		if v == nil {
+			doc[k.MappingName] = nil
+		}
+	}
+	doc["id"] = id
+	return &Action{Op: OpUpdate, Id: id, Doc: doc, Upsert: true}
+}
+
+// PartialAction 只更新 data 中的字段，用于附表变更，文档不存在时不创建
+func (c *Client) PartialAction(key []interface{}, data map[*config.Coll]interface{}) *Action {
+	doc := make(map[string]interface{})
+	for k, v := range data {
+		doc[k.MappingName] = v
+	}
+	return &Action{Op: OpUpdate, Id: c.rule.MainTable.DocId(key), Doc: doc}
+}
+
+// bulk 发送 bulk 请求，只重试其中返回可重试状态的条目，最终失败的条目以 BulkError 返回
+// BulkError 中条目的 pos 对应 actions 中的下标
+func (c *Client) bulk(actions []*Action) error {
+	var items []string
+	var positions []int
+	var failed []*ItemError
+	for i, a := range actions {
+		item, err := a.encode()
+		if err != nil {
+			failed = append(failed, &ItemError{Id: fmt.Sprintf("%v", a.Id), Action: a.Op, Type: "encode_exception", Reason: err.Error(), pos: i})
+			continue
+		}
+		items = append(items, item)
+		positions = append(positions, i)
+	}
+	err := c.retry(func() error {
+		if len(items) == 0 {
+			return nil
+		}
+		_, resBody, err := c.request("POST", c.bulkPath(), []byte(strings.Join(items, "\n")+"\n"))
+		if err != nil {
+			return err
+		}
+		err = parseBulkResponse(resBody)
+		bulkErr, ok := err.(*BulkError)
+		if !ok {
+			return err
+		}
+		var retryItems []string
+		var retryPositions []int
+		var retryErr = &BulkError{Total: len(items)}
+		for _, item := range bulkErr.Items {
+			local := item.pos
+			item.pos = positions[local]
+			if documentMissing(actions[item.pos], item) {
+				continue
+			}
+			if retryableStatus(item.Status) {
+				retryItems = append(retryItems, items[local])
+				retryPositions = append(retryPositions, item.pos)
+				retryErr.Items = append(retryErr.Items, item)
+			} else {
+				failed = append(failed, item)
+			}
+		}
+		items = retryItems
+		positions = retryPositions
+		if len(retryItems) > 0 {
+			return retryErr
+		}
+		return nil
+	})
+	if bulkErr, ok := err.(*BulkError); ok {
+		failed = append(failed, bulkErr.Items...)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &BulkError{len(actions), failed}
+	}
+	return nil
+}
+
+// documentMissing 局部更新（不 upsert）的文档不存在，视为成功
+// 附表变更按 MySQL 当前数据查出主表ID，binlog 消费落后时主表的插入还没有写入，之后的插入会写入完整文档
+func documentMissing(a *Action, item *ItemError) bool {
+	return a.Op == OpUpdate && !a.Upsert && item.Status == http.StatusNotFound && item.Type == "document_missing_exception"
+}
+
+type pendingAction struct {
+	action   *Action
+	callback func(err error)
+}
+
+// BulkProcessor 缓冲写入操作，按条数、大小或时间间隔批量刷新
+// 批次由同一个协程按加入的顺序依次发送，同一文档的操作不会乱序；发送协程繁忙时 Add 阻塞，从而反压上游
+type BulkProcessor struct {
+	c          *Client
+	mu         sync.Mutex
+	pending    []*pendingAction
+	size       int
+	maxActions int
+	maxBytes   int
+	batches    chan []*pendingAction
+	// 关闭后停止定时刷新，发送协程发送完剩余的批次后关闭 done
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (c *Client) NewBulkProcessor() *BulkProcessor {
+	p := &BulkProcessor{
+		c:          c,
+		maxActions: c.conf.BulkMaxActions,
+		maxBytes:   c.conf.BulkMaxBytes,
+		batches:    make(chan []*pendingAction, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go p.run()
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.conf.BulkFlushIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Flush()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Close 发送缓冲中剩余的操作并等待全部批次发送完成（回调均已执行），之后不能再调用 Add
+func (p *BulkProcessor) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.flush()
+	p.closed = true
+	close(p.batches)
+	p.mu.Unlock()
+	close(p.stop)
+	<-p.done
+}
+
+// Add 添加一个操作，该操作最终写入成功或失败后调用 callback，失败时 err 为该条目的失败原因
+func (p *BulkProcessor) Add(a *Action, callback func(err error)) {
+	line, err := a.encode()
+	if err != nil {
+		callback(&ItemError{Id: fmt.Sprintf("%v", a.Id), Action: a.Op, Type: "encode_exception", Reason: err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, &pendingAction{a, callback})
+	p.size += len(line) + 1
+	if len(p.pending) >= p.maxActions || p.size >= p.maxBytes {
+		p.flush()
+	}
+}
+
+// Flush 将当前缓冲的操作交给发送协程
+func (p *BulkProcessor) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flush()
+}
+
+// flush 必须在持有锁时调用，保证批次按取出的顺序进入发送队列
+func (p *BulkProcessor) flush() {
+	if len(p.pending) == 0 || p.closed {
+		return
+	}
+	p.batches <- p.pending
+	p.pending = nil
+	p.size = 0
+}
+
+func (p *BulkProcessor) run() {
+	defer close(p.done)
+	for batch := range p.batches {
+		actions := make([]*Action, len(batch))
+		for i, pa := range batch {
+			actions[i] = pa.action
+		}
+		err := p.c.bulk(actions)
+		itemErrs := make(map[int]error)
+		if bulkErr, ok := err.(*BulkError); ok {
+			for _, item := range bulkErr.Items {
+				itemErrs[item.pos] = item
+			}
+			err = nil
+		}
+		if err != nil {
+			log.Errorf("[BULK] %v 条写入失败... %v", len(batch), err)
+		}
+		for i, pa := range batch {
+			if err != nil {
+				pa.callback(err)
+			} else {
+				pa.callback(itemErrs[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package es
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go-mysql2es/src/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bulkServer 模拟 _bulk 接口，按请求次数依次返回 responses 中的状态码，每个状态码对应请求中的一条
+type bulkServer struct {
+	mu        sync.Mutex
+	responses [][]int
+	// 每次请求中的文档ID
+	requests [][]string
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	var ops []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := map[string]json.RawMessage{}
+		if json.Unmarshal(scanner.Bytes(), &line) != nil || len(line) != 1 {
+			continue
+		}
+		for op, raw := range line {
+			if op != OpIndex && op != OpUpdate && op != OpDelete {
+				continue
+			}
+			meta := struct {
+				Id string `json:"_id"`
+			}{}
+			_ = json.Unmarshal(raw, &meta)
+			ids = append(ids, meta.Id)
+			ops = append(ops, op)
+		}
+	}
+	s.mu.Lock()
+	n := len(s.requests)
+	s.requests = append(s.requests, ids)
+	s.mu.Unlock()
+	if n >= len(s.responses) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var items []string
+	hasErr := false
+	for i, status := range s.responses[n] {
+		errBody := ""
+		switch {
+		case status == http.StatusTooManyRequests:
+			errBody = `,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}`
+		case status == http.StatusNotFound && ops[i] == OpUpdate:
+			errBody = `,"error":{"type":"document_missing_exception","reason":"missing"}`
+		case status >= 300 && status != http.StatusNotFound:
+			errBody = `,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}`
+		}
+		hasErr = hasErr || status >= 300
+		items = append(items, fmt.Sprintf(`{"%v":{"_id":"%v","status":%v%v}}`, ops[i], ids[i], status, errBody))
+	}
+	_, _ = fmt.Fprintf(w, `{"errors":%v,"items":[%v]}`, hasErr, strings.Join(items, ","))
+}
+
+func newTestClient(t *testing.T, handler http.Handler, maxAttempts int, blockOnFailure bool) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c := New(&config.Conf{ES: &config.ESConf{
+		Nodes:                 []string{server.URL},
+		NodeSelector:          "roundRobin",
+		HealthCheckIntervalMs: 60000,
+		Index:                 "test",
+		Version:               "7.10.0",
+		RetryMaxAttempts:      maxAttempts,
+		RetryInitialBackoffMs: 1,
+		RetryMaxBackoffMs:     1,
+		BlockOnFailure:        blockOnFailure,
+		BreakerThreshold:      100,
+		BreakerOpenMs:         1,
+		BulkMaxActions:        100,
+		BulkMaxBytes:          1 << 20,
+		BulkFlushIntervalMs:   60000,
+	}})
+	if err := c.DetectVersion(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func indexActions(ids ...string) []*Action {
+	var actions []*Action
+	for _, id := range ids {
+		actions = append(actions, &Action{Op: OpIndex, Id: id, Doc: map[string]interface{}{"name": id}})
+	}
+	return actions
+}
+
+// assertFailed 检查失败条目的ID与在 actions 中的下标
+func assertFailed(t *testing.T, err error, want map[string]int) {
+	t.Helper()
+	bulkErr, ok := err.(*BulkError)
+	if !ok {
+		t.Fatalf("err = %v, want BulkError", err)
+	}
+	if len(bulkErr.Items) != len(want) {
+		t.Fatalf("failed = %v, want %v", bulkErr, want)
+	}
+	for _, item := range bulkErr.Items {
+		pos, ok := want[item.Id]
+		if !ok || pos != item.pos {
+			t.Fatalf("failed item %v at %v, want %v", item.Id, item.pos, want)
+		}
+	}
+}
+
+func assertRequests(t *testing.T, s *bulkServer, want ...string) {
+	t.Helper()
+	if len(s.requests) != len(want) {
+		t.Fatalf("requests = %v, want %v", s.requests, want)
+	}
+	for i, ids := range s.requests {
+		if got := strings.Join(ids, ","); got != want[i] {
+			t.Fatalf("request %v = %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestBulkSuccess(t *testing.T) {
+	s := &bulkServer{responses: [][]int{{201, 200}}}
+	c := newTestClient(t, s, 3, false)
+	if err := c.bulk(indexActions("1", "2")); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	assertRequests(t, s, "1,2")
+}
+
+func TestBulkRetriesOnlyRetryableItems(t *testing.T) {
+	// 第一次 2、4 返回 429，3 返回 400；重试时只发送 2、4
+	s := &bulkServer{responses: [][]int{{201, 429, 400, 429}, {201, 201}}}
+	c := newTestClient(t, s, 3, false)
+	err := c.bulk(indexActions("1", "2", "3", "4"))
+	assertRequests(t, s, "1,2,3,4", "2,4")
+	assertFailed(t, err, map[string]int{"3": 2})
+}
+
+func TestBulkRetryRemapsPositions(t *testing.T) {
+	// 重试中的第二条（原第四条）仍然失败，下标要对应回原来的 actions
+	s := &bulkServer{responses: [][]int{{429, 201, 201, 429}, {201, 429}, {429}}}
+	c := newTestClient(t, s, 3, false)
+	err := c.bulk(indexActions("1", "2", "3", "4"))
+	assertRequests(t, s, "1,2,3,4", "1,4", "4")
+	assertFailed(t, err, map[string]int{"4": 3})
+	if !IsRetryable(err.(*BulkError).Items[0]) {
+		t.Fatal("exhausted 429 item should keep its retryable status")
+	}
+}
+
+func TestBulkEncodeFailure(t *testing.T) {
+	actions := indexActions("1", "2", "3")
+	actions[0].Doc["bad"] = make(chan int)
+	s := &bulkServer{responses: [][]int{{201, 400}}}
+	c := newTestClient(t, s, 3, false)
+	err := c.bulk(actions)
+	// 无法编码的条目不发送，其余条目的下标不受影响
+	assertRequests(t, s, "2,3")
+	assertFailed(t, err, map[string]int{"1": 0, "3": 2})
+}
+
+func TestBulkDocumentMissing(t *testing.T) {
+	actions := []*Action{
+		{Op: OpUpdate, Id: "1", Doc: map[string]interface{}{"name": "a"}},
+		{Op: OpUpdate, Id: "2", Doc: map[string]interface{}{"name": "b"}, Upsert: true},
+		{Op: OpDelete, Id: "3"},
+	}
+	s := &bulkServer{responses: [][]int{{404, 404, 404}}}
+	c := newTestClient(t, s, 3, false)
+	err := c.bulk(actions)
+	// 局部更新与删除的文档不存在视为成功，upsert 返回 404 仍然是失败
+	assertFailed(t, err, map[string]int{"2": 1})
+}
+
+func TestBulkRequestFailure(t *testing.T) {
+	s := &bulkServer{}
+	c := newTestClient(t, s, 2, false)
+	err := c.bulk(indexActions("1", "2"))
+	if re, ok := err.(*ResponseError); !ok || re.Status != http.StatusInternalServerError {
+		t.Fatalf("err = %v, want 500 ResponseError", err)
+	}
+	// 500 不可重试
+	assertRequests(t, s, "1,2")
+}
+
+func TestBulkBlockOnFailure(t *testing.T) {
+	// 超过重试次数后继续重试 429 的条目，直到写入成功
+	s := &bulkServer{responses: [][]int{{201, 429}, {429}, {429}, {201}}}
+	c := newTestClient(t, s, 1, true)
+	if err := c.bulk(indexActions("1", "2")); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	assertRequests(t, s, "1,2", "2", "2", "2")
+}
+
+func TestBulkNoBlockOnFailure(t *testing.T) {
+	s := &bulkServer{responses: [][]int{{201, 429}, {429}, {201}}}
+	c := newTestClient(t, s, 2, false)
+	err := c.bulk(indexActions("1", "2"))
+	assertRequests(t, s, "1,2", "2")
+	assertFailed(t, err, map[string]int{"2": 1})
+}
+
+func TestBulkProcessorCallbacks(t *testing.T) {
+	s := &bulkServer{responses: [][]int{{201, 400, 429}, {201}}}
+	c := newTestClient(t, s, 3, false)
+	p := c.NewBulkProcessor()
+	errs := make([]error, 3)
+	called := make([]bool, 3)
+	for i, a := range indexActions("1", "2", "3") {
+		i := i
+		p.Add(a, func(err error) {
+			errs[i] = err
+			called[i] = true
+		})
+	}
+	// Close 会发送剩余的操作并等待回调执行完
+	p.Close()
+	for i := range called {
+		if !called[i] {
+			t.Fatalf("callback %v not called", i)
+		}
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Fatalf("errs = %v, want only the second to fail", errs)
+	}
+	if itemErr, ok := errs[1].(*ItemError); !ok || itemErr.Id != "2" || itemErr.Status != 400 {
+		t.Fatalf("err = %v, want 400 ItemError", errs[1])
+	}
+}
+
+func TestBulkProcessorRequestFailure(t *testing.T) {
+	s := &bulkServer{}
+	c := newTestClient(t, s, 1, false)
+	p := c.NewBulkProcessor()
+	errs := make([]error, 2)
+	for i, a := range indexActions("1", "2") {
+		i := i
+		p.Add(a, func(err error) {
+			errs[i] = err
+		})
+	}
+	p.Close()
+	// 请求整体失败时每条都收到 ResponseError
+	for i, err := range errs {
+		if _, ok := err.(*ResponseError); !ok {
+			t.Fatalf("err %v = %v, want ResponseError", i, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ResponseError ES 返回了非 2xx 的状态码
+type ResponseError struct {
+	Method string
+	Url    string
+	Status int
+	Body   string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("[ES] %v %v 返回 %v: %v", e.Method, e.Url, e.Status, e.Body)
+}
+
+// ItemError bulk 请求中单条文档的失败信息
+type ItemError struct {
+	Id     string
+	Action string
+	Status int
+	Type   string
+	Reason string
+	// 在 bulk 请求中的序号
+	pos int
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("[ES] %v %v 失败 status: %v type: %v reason: %v", e.Action, e.Id, e.Status, e.Type, e.Reason)
+}
+
+// BulkError bulk 请求整体成功，但其中部分文档写入失败
+type BulkError struct {
+	Total int
+	Items []*ItemError
+}
+
+func (e *BulkError) Error() string {
+	var lines []string
+	for i, item := range e.Items {
+		if i >= 5 {
+			lines = append(lines, fmt.Sprintf("... 等%v条", len(e.Items)))
+			break
+		}
+		lines = append(lines, item.Error())
+	}
+	return fmt.Sprintf("[ES] bulk 共%v条，失败%v条: %v", e.Total, len(e.Items), strings.Join(lines, "; "))
+}
+
+// Ids 返回失败文档的ID，便于调用方只重试或转储这部分数据
+func (e *BulkError) Ids() []string {
+	var ids []string
+	for _, item := range e.Items {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkItemResponse `json:"items"`
+}
+
+type bulkItemResponse struct {
+	Id     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type     string `json:"type"`
+		Reason   string `json:"reason"`
+		CausedBy *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"caused_by"`
+	} `json:"error"`
+}
+
+// parseBulkResponse 解析 _bulk 返回体，全部成功时返回 nil
+func parseBulkResponse(body []byte) error {
+	resp := &bulkResponse{}
+	err := json.Unmarshal(body, resp)
+	if err != nil {
+		return fmt.Errorf("[ES] 解析 bulk 返回失败 %v: %v", err, string(body))
+	}
+	if !resp.Errors {
+		return nil
+	}
+	bulkErr := &BulkError{Total: len(resp.Items)}
+	for i, item := range resp.Items {
+		for action, r := range item {
+			if r.Error == nil && (r.Status < 300 || (action == OpDelete && r.Status == http.StatusNotFound)) {
+				continue
+			}
+			itemErr := &ItemError{Id: r.Id, Action: action, Status: r.Status, pos: i}
+			if r.Error != nil {
+				itemErr.Type = r.Error.Type
+				itemErr.Reason = r.Error.Reason
+				if r.Error.CausedBy != nil {
+					itemErr.Reason += " caused by: " + r.Error.CausedBy.Reason
+				}
+			}
+			bulkErr.Items = append(bulkErr.Items, itemErr)
+		}
+	}
+	if len(bulkErr.Items) == 0 {
+		return nil
+	}
+	return bulkErr
+}
@@ -0,0 +1,77 @@
+package es
+
+import (
+	"testing"
+)
+
+func TestParseBulkResponseSuccess(t *testing.T) {
+	body := `{"errors":false,"items":[{"index":{"_id":"1","status":201}},{"delete":{"_id":"2","status":200}}]}`
+	if err := parseBulkResponse([]byte(body)); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+}
+
+func TestParseBulkResponseMixed(t *testing.T) {
+	body := `{"errors":true,"items":[
+		{"index":{"_id":"1","status":201}},
+		{"update":{"_id":"2","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}},
+		{"delete":{"_id":"3","status":404}},
+		{"index":{"_id":"4","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse","caused_by":{"type":"illegal_argument_exception","reason":"bad value"}}}},
+		{"update":{"_id":"5","status":404,"error":{"type":"document_missing_exception","reason":"missing"}}}
+	]}`
+	err := parseBulkResponse([]byte(body))
+	bulkErr, ok := err.(*BulkError)
+	if !ok {
+		t.Fatalf("err = %v, want BulkError", err)
+	}
+	if bulkErr.Total != 5 {
+		t.Fatalf("total = %v, want 5", bulkErr.Total)
+	}
+	// 删除不存在的文档视为成功
+	want := []struct {
+		id     string
+		action string
+		status int
+		typ    string
+		pos    int
+	}{
+		{"2", OpUpdate, 429, "es_rejected_execution_exception", 1},
+		{"4", OpIndex, 400, "mapper_parsing_exception", 3},
+		{"5", OpUpdate, 404, "document_missing_exception", 4},
+	}
+	if len(bulkErr.Items) != len(want) {
+		t.Fatalf("items = %v, want %v", bulkErr.Items, len(want))
+	}
+	for i, w := range want {
+		item := bulkErr.Items[i]
+		if item.Id != w.id || item.Action != w.action || item.Status != w.status || item.Type != w.typ || item.pos != w.pos {
+			t.Fatalf("item %v = %+v, want %+v", i, item, w)
+		}
+	}
+	if reason := bulkErr.Items[1].Reason; reason != "failed to parse caused by: bad value" {
+		t.Fatalf("reason = %v", reason)
+	}
+	if ids := bulkErr.Ids(); len(ids) != 3 || ids[0] != "2" || ids[1] != "4" || ids[2] != "5" {
+		t.Fatalf("ids = %v", ids)
+	}
+}
+
+func TestParseBulkResponseOnlyMissingDelete(t *testing.T) {
+	body := `{"errors":true,"items":[{"delete":{"_id":"1","status":404}}]}`
+	if err := parseBulkResponse([]byte(body)); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+}
+
+func TestParseBulkResponseInvalid(t *testing.T) {
+	err := parseBulkResponse([]byte(`<html>bad gateway</html>`))
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if _, ok := err.(*BulkError); ok {
+		t.Fatal("invalid body should not be a BulkError")
+	}
+	if IsRetryable(err) {
+		t.Fatal("invalid body should not be retryable")
+	}
+}
@@ -1,134 +1,179 @@
 package es
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"go-mysql2es/src/config"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
-	conf     *config.ESConf
-	rule     *config.Rule
-	client   *http.Client
-	keyField string
+	conf    *config.ESConf
+	rule    *config.Rule
+	client  *http.Client
+	breaker *breaker
+	// ES 7 及以上、OpenSearch 不再使用 mapping type
+	typeless bool
+	major    int
+	// ES 7.10 起支持 unsigned_long
+	unsignedLong bool
+	// ES 6.4 起别名操作支持 remove_index
+	removeIndex bool
+	pool        *nodePool
 }
 
 func New(conf *config.Conf) *Client {
-	return &Client{conf.ES, conf.Rule, &http.Client{}, fmt.Sprintf("%v.%v", conf.Rule.MainTable.TableName, conf.Rule.MainTable.MainCollName)}
+	b := &breaker{threshold: conf.ES.BreakerThreshold, openTime: time.Duration(conf.ES.BreakerOpenMs) * time.Millisecond}
+	client, err := newHttpClient(conf.ES)
+	if err != nil {
+		log.Panicf("[ES] 加载证书失败, %v", err)
+	}
+	pool := newNodePool(conf.ES.Nodes, conf.ES.NodeSelector)
+	c := &Client{conf.ES, conf.Rule, client, b, false, 0, false, false, pool}
+	go c.healthCheck(time.Duration(conf.ES.HealthCheckIntervalMs) * time.Millisecond)
+	if conf.ES.Sniff {
+		go c.sniff(time.Duration(conf.ES.SniffIntervalMs) * time.Millisecond)
+	}
+	return c
 }
 
-func (c *Client) Upsert(data map[*config.Coll]interface{}) error {
-	var id interface{}
-	mappingParams := make(map[string]interface{})
-	for k, v := range data {
-		mappingParams[k.MappingName] = v
-		if k.FullName == c.keyField {
-			id = v
-		}
-	}
-	url := fmt.Sprintf("http://%v:%v/%v/%v/%v", c.conf.Host, c.conf.Port, c.conf.Index, c.conf.Type, id)
-	method := "PUT"
-	dataStr, _ := json.Marshal(mappingParams)
-	payload := strings.NewReader(string(dataStr))
-	req, err := http.NewRequest(method, url, payload)
-	if err != nil {
+// do 发送请求，可重试的错误按配置重试，每次重试都会重新选择节点
+func (c *Client) do(method string, path string, body []byte, accept ...int) (status int, resBody []byte, err error) {
+	err = c.retry(func() error {
+		status, resBody, err = c.request(method, path, body, accept...)
 		return err
+	})
+	return status, resBody, err
+}
+
+// request 选择一个节点发送请求并读取完整的返回体，非 2xx 且不在 accept 中的状态码以 ResponseError 返回
+// 网络错误时摘除该节点
+func (c *Client) request(method string, path string, body []byte, accept ...int) (int, []byte, error) {
+	return c.requestContext(context.Background(), method, path, body, accept...)
+}
+
+// requestContext 与 request 相同，ctx 的超时比 http.Client 的超时短时以 ctx 为准
+func (c *Client) requestContext(ctx context.Context, method string, path string, body []byte, accept ...int) (int, []byte, error) {
+	n := c.pool.pick()
+	atomic.AddInt64(&n.inflight, 1)
+	defer atomic.AddInt64(&n.inflight, -1)
+	url := n.url + path
+	var payload io.Reader
+	if body != nil {
+		payload = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return 0, nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	c.authorize(req)
 	res, err := c.client.Do(req)
 	if err != nil {
-		return err
+		c.pool.markDead(n)
+		return 0, nil, err
 	}
 	defer func() { _ = res.Body.Close() }()
-	_, err = ioutil.ReadAll(res.Body)
+	resBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return res.StatusCode, nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res.StatusCode, resBody, nil
+	}
+	for _, status := range accept {
+		if res.StatusCode == status {
+			return res.StatusCode, resBody, nil
+		}
 	}
-	return nil
+	return res.StatusCode, resBody, &ResponseError{method, url, res.StatusCode, string(resBody)}
 }
 
-func (c *Client) BatchInsert(datas []map[*config.Coll]interface{}) error {
-	var body []string
-	for _, data := range datas {
-		var id interface{}
-		mappingParams := make(map[string]interface{})
-		for k, v := range data {
-			mappingParams[k.MappingName] = v
-			if k.FullName == c.keyField {
-				id = v
-				mappingParams["id"] = id
-			}
+// Doc 将一行数据转换为ES文档，返回文档ID与文档内容
+func (c *Client) Doc(data map[*config.Coll]interface{}) (interface{}, map[string]interface{}) {
+	mainTable := c.rule.MainTable
+	key := make([]interface{}, len(mainTable.KeyCollNames))
+	for i, name := range mainTable.KeyCollNames {
+		key[i] = data[mainTable.CollList[name]]
+	}
+	id := mainTable.DocId(key)
+	mappingParams := make(map[string]interface{})
+	for k, v := range data {
+		// 整个文档会被覆盖写入，省略的字段与 null 一样会从文档中消失
+		if v == nil && c.conf.OmitNull {
+			continue
 		}
-		dataStr, _ := json.Marshal(mappingParams)
-		body = append(body, fmt.Sprintf(`{"index":{"_id":%v}}`, id))
-		body = append(body, string(dataStr))
-	}
-	url := fmt.Sprintf("http://%v:%v/%v/%v/_bulk", c.conf.Host, c.conf.Port, c.conf.Index, c.conf.Type)
-	method := "POST"
-	payload := strings.NewReader(strings.Join(body, "\n") + "\n")
-	req, err := http.NewRequest(method, url, payload)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.client.Do(req)
-	if err != nil {
-		return err
+		mappingParams[k.MappingName] = v
 	}
-	defer func() { _ = res.Body.Close() }()
-	_, err = ioutil.ReadAll(res.Body)
+	return id, mappingParams
+}
+
+func (c *Client) Upsert(data map[*config.Coll]interface{}) error {
+	return c.Index(c.Doc(data))
+}
+
+// Index 写入一个已经转换好的文档
+func (c *Client) Index(id interface{}, doc map[string]interface{}) error {
+	dataStr, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, _, err = c.do("PUT", c.docPath(id), dataStr)
+	return err
 }
 
-func (c *Client) Update() error {
-	return nil
+func (c *Client) BatchInsert(datas []map[*config.Coll]interface{}) error {
+	if len(datas) == 0 {
+		return nil
+	}
+	var actions []*Action
+	for _, data := range datas {
+		actions = append(actions, c.IndexAction(data))
+	}
+	return c.bulk(actions)
 }
 
-func (c *Client) Delete(id interface{}) error {
-	url := fmt.Sprintf("http://%v:%v/%v/%v/%v", c.conf.Host, c.conf.Port, c.conf.Index, c.conf.Type, id)
-	method := "DELETE"
-	req, err := http.NewRequest(method, url, nil)
+// Update 局部更新文档，upsert 为 true 时文档不存在则以 doc 创建
+func (c *Client) Update(id interface{}, doc map[string]interface{}, upsert bool) error {
+	dataStr, err := json.Marshal(map[string]interface{}{"doc": doc, "doc_as_upsert": upsert})
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	res, err := c.client.Do(req)
-	if err != nil {
+	if upsert {
+		_, _, err = c.do("POST", c.updatePath(id), dataStr)
 		return err
 	}
-	defer func() { _ = res.Body.Close() }()
-	_, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+	// 与 bulk 相同，局部更新的文档不存在时视为成功，索引不存在等其他 404 仍然返回错误
+	status, body, err := c.do("POST", c.updatePath(id), dataStr, http.StatusNotFound)
+	if err == nil && status == http.StatusNotFound && !strings.Contains(string(body), "document_missing_exception") {
+		return &ResponseError{"POST", c.updatePath(id), status, string(body)}
 	}
-	return nil
+	return err
 }
 
+// Delete 删除文档，文档不存在视为成功
+func (c *Client) Delete(id interface{}) error {
+	_, _, err := c.do("DELETE", c.docPath(id), nil, http.StatusNotFound)
+	return err
+}
+
+// Count 索引不存在时返回 0
 func (c *Client) Count() (uint64, error) {
-	url := fmt.Sprintf("http://%v:%v/%v/_count", c.conf.Host, c.conf.Port, c.conf.Index)
-	method := "GET"
-	req, err := http.NewRequest(method, url, nil)
+	status, body, err := c.do("GET", fmt.Sprintf("/%v/_count", c.conf.Index), nil, http.StatusNotFound)
 	if err != nil {
 		return 0, err
 	}
-	res, err := c.client.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer func() { _ = res.Body.Close() }()
-	if res.StatusCode != 200 {
+	if status == http.StatusNotFound {
 		return 0, nil
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return 0, err
-	}
 	m := make(map[string]interface{})
 	err = json.Unmarshal(body, &m)
 	if err != nil {
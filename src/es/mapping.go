@@ -0,0 +1,283 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/config"
+	"strings"
+)
+
+// properties 根据 rule 中的字段生成 mapping，字段名中的 . 会展开为 object
+// explicit 为 true 时只包含配置了类型或分词器的字段，且只输出配置的部分，用于检查已有索引
+func (c *Client) properties(explicit bool) map[string]interface{} {
+	var colls []*config.Coll
+	for _, coll := range c.rule.MainTable.CollList {
+		colls = append(colls, coll)
+	}
+	var manyTables []*config.JoinTable
+	for _, table := range c.rule.JoinTables {
+		if table.Many {
+			manyTables = append(manyTables, table)
+			continue
+		}
+		for _, coll := range table.CollList {
+			colls = append(colls, coll)
+		}
+	}
+	props := c.collProperties(colls, explicit)
+	// 一对多的附表聚合为对象数组，数组中的字段定义在该字段的 properties 中
+	for _, table := range manyTables {
+		var manyColls []*config.Coll
+		for _, coll := range table.CollList {
+			manyColls = append(manyColls, coll)
+		}
+		field := map[string]interface{}{"properties": c.collProperties(manyColls, explicit)}
+		if table.ArrayType == "nested" {
+			field["type"] = "nested"
+		}
+		setProperty(props, table.ArrayName, field)
+	}
+	if explicit {
+		return props
+	}
+	// 写入时文档中会带上与文档ID同值的 id 字段，使用模板生成的文档ID是字符串
+	mainTable := c.rule.MainTable
+	idType := "keyword"
+	if mainTable.DocIdTemplate == "" {
+		idType = c.esType(mainTable.CollList[mainTable.KeyCollNames[0]])
+	}
+	if idType != "" {
+		setProperty(props, "id", map[string]interface{}{"type": idType})
+	}
+	return props
+}
+
+func (c *Client) collProperties(colls []*config.Coll, explicit bool) map[string]interface{} {
+	props := make(map[string]interface{})
+	for _, coll := range colls {
+		if coll.EsType == "" || explicit && !coll.ExplicitType && coll.Analyzer == "" {
+			continue
+		}
+		field := make(map[string]interface{})
+		if !explicit || coll.ExplicitType {
+			field["type"] = c.esType(coll)
+		}
+		if coll.Analyzer != "" {
+			field["analyzer"] = coll.Analyzer
+		}
+		setProperty(props, coll.MappingName, field)
+	}
+	return props
+}
+
+// esType 推导的 unsigned_long 在不支持的版本上改为 keyword，避免大于 2^63-1 的值写入 long 失败
+func (c *Client) esType(coll *config.Coll) string {
+	if coll.EsType == "unsigned_long" && !coll.ExplicitType && !c.unsignedLong {
+		return "keyword"
+	}
+	return coll.EsType
+}
+
+func setProperty(props map[string]interface{}, name string, field map[string]interface{}) {
+	path := strings.Split(name, ".")
+	for _, p := range path[:len(path)-1] {
+		obj, ok := props[p].(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{"properties": make(map[string]interface{})}
+			props[p] = obj
+		}
+		props = obj["properties"].(map[string]interface{})
+	}
+	props[path[len(path)-1]] = field
+}
+
+// mappings ES 5/6 的 mapping 需要包一层 type
+func (c *Client) mappings(props map[string]interface{}) map[string]interface{} {
+	if c.typeless {
+		return map[string]interface{}{"properties": props}
+	}
+	return map[string]interface{}{c.conf.Type: map[string]interface{}{"properties": props}}
+}
+
+func (c *Client) mappingPath() string {
+	if c.typeless {
+		return fmt.Sprintf("/%v/_mapping", c.conf.Index)
+	}
+	return fmt.Sprintf("/%v/_mapping/%v", c.conf.Index, c.conf.Type)
+}
+
+// EnsureIndex 索引不存在时按配置的 settings 与字段类型创建索引（或索引模板）
+// 索引已存在时只检查配置了类型或分词器的字段，不一致时返回错误；推导的类型不做检查，
+// 已有索引中动态映射的字段（如 long、text）保持不变，缺少的字段按推导的类型补充
+func (c *Client) EnsureIndex() error {
+	exists, err := c.IndexExists(c.conf.Index)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.CreateIndex(c.conf.Index)
+	}
+	props := c.properties(false)
+	if c.conf.Template {
+		err = c.putTemplate(props)
+		if err != nil {
+			return err
+		}
+	}
+	return c.checkMapping(c.properties(true), props)
+}
+
+// CreateIndex 使用 rule 中的字段类型创建索引，使用索引模板时先更新模板
+func (c *Client) CreateIndex(index string) error {
+	props := c.properties(false)
+	if c.conf.Template {
+		err := c.putTemplate(props)
+		if err != nil {
+			return err
+		}
+	}
+	body := map[string]interface{}{"mappings": c.mappings(props)}
+	if !c.conf.Template && len(c.conf.Settings) > 0 {
+		body["settings"] = c.conf.Settings
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("PUT", "/"+index, data)
+	if err != nil {
+		return err
+	}
+	log.Infof("[ES] 创建索引 %v", index)
+	return nil
+}
+
+func (c *Client) putTemplate(props map[string]interface{}) error {
+	body := map[string]interface{}{"mappings": c.mappings(props)}
+	if c.major == 5 {
+		body["template"] = c.conf.Index + "*"
+	} else {
+		body["index_patterns"] = []string{c.conf.Index + "*"}
+	}
+	if len(c.conf.Settings) > 0 {
+		body["settings"] = c.conf.Settings
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("PUT", "/_template/"+c.conf.Index, data)
+	if err != nil {
+		return err
+	}
+	log.Infof("[ES] 更新索引模板 %v", c.conf.Index)
+	return nil
+}
+
+// checkMapping explicit 为需要与已有字段一致的部分，props 中已有索引缺少的字段逐个索引补充
+func (c *Client) checkMapping(explicit map[string]interface{}, props map[string]interface{}) error {
+	_, body, err := c.do("GET", c.mappingPath(), nil)
+	if err != nil {
+		return err
+	}
+	indices := make(map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	})
+	err = json.Unmarshal(body, &indices)
+	if err != nil {
+		return fmt.Errorf("[ES] 解析 mapping 失败 %v: %v", err, string(body))
+	}
+	missing := make(map[string]map[string]interface{})
+	for index, info := range indices {
+		mappings := info.Mappings
+		if !c.typeless {
+			mappings, _ = mappings[c.conf.Type].(map[string]interface{})
+		}
+		existing, _ := mappings["properties"].(map[string]interface{})
+		err := compareProperties(explicit, existing, "")
+		if err != nil {
+			return fmt.Errorf("[ES] 索引 %v 已有 mapping 与配置不兼容, %v", index, err)
+		}
+		if m := missingProperties(props, existing); len(m) > 0 {
+			missing[index] = m
+		}
+	}
+	// 别名下的多个索引缺少的字段可能不同，分别补充
+	for index, m := range missing {
+		data, err := json.Marshal(map[string]interface{}{"properties": m})
+		if err != nil {
+			return err
+		}
+		path := fmt.Sprintf("/%v/_mapping", index)
+		if !c.typeless {
+			path += "/" + c.conf.Type
+		}
+		_, _, err = c.do("PUT", path, data)
+		if err != nil {
+			return err
+		}
+		log.Infof("[ES] 索引 %v 补充字段 mapping", index)
+	}
+	return nil
+}
+
+// compareProperties 检查配置的字段与已有字段是否一致，已有索引中缺少的字段不做检查
+func compareProperties(expected map[string]interface{}, existing map[string]interface{}, prefix string) error {
+	for name, v := range expected {
+		def := v.(map[string]interface{})
+		cur, ok := existing[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if sub, ok := def["properties"].(map[string]interface{}); ok {
+			curSub, _ := cur["properties"].(map[string]interface{})
+			if curSub == nil {
+				return fmt.Errorf("%v%v 已存在且类型为 %v，不是 object", prefix, name, cur["type"])
+			}
+			// nested 与 object 不能互相转换
+			if def["type"] != cur["type"] {
+				return fmt.Errorf("%v%v 已有类型 %v，配置类型 %v", prefix, name, cur["type"], def["type"])
+			}
+			err := compareProperties(sub, curSub, prefix+name+".")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if esType, ok := def["type"]; ok && cur["type"] != esType {
+			return fmt.Errorf("%v%v 已有类型 %v，配置类型 %v", prefix, name, cur["type"], esType)
+		}
+		if analyzer, ok := def["analyzer"]; ok && cur["analyzer"] != analyzer {
+			return fmt.Errorf("%v%v 已有分词器 %v，配置分词器 %v", prefix, name, cur["analyzer"], analyzer)
+		}
+	}
+	return nil
+}
+
+// missingProperties 返回已有字段中缺少的部分，object 与 nested 字段逐层比较
+func missingProperties(expected map[string]interface{}, existing map[string]interface{}) map[string]interface{} {
+	missing := make(map[string]interface{})
+	for name, v := range expected {
+		def := v.(map[string]interface{})
+		cur, ok := existing[name].(map[string]interface{})
+		if !ok {
+			missing[name] = def
+			continue
+		}
+		sub, _ := def["properties"].(map[string]interface{})
+		curSub, _ := cur["properties"].(map[string]interface{})
+		if sub == nil || curSub == nil {
+			continue
+		}
+		if m := missingProperties(sub, curSub); len(m) > 0 {
+			field := map[string]interface{}{"properties": m}
+			// 补充 nested 字段的子字段时需要带上原有的类型
+			if esType, ok := cur["type"]; ok {
+				field["type"] = esType
+			}
+			missing[name] = field
+		}
+	}
+	return missing
+}
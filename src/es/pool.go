@@ -0,0 +1,204 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SelectorRoundRobin = "roundRobin"
+
+const SelectorLeastLoaded = "leastLoaded"
+
+type node struct {
+	url      string
+	inflight int64
+	dead     int32
+}
+
+func (n *node) alive() bool {
+	return atomic.LoadInt32(&n.dead) == 0
+}
+
+// nodePool 维护集群节点，按配置的策略选择节点，请求失败的节点暂时摘除，由健康检查恢复
+type nodePool struct {
+	mu       sync.RWMutex
+	nodes    []*node
+	selector string
+	next     uint64
+}
+
+func newNodePool(urls []string, selector string) *nodePool {
+	p := &nodePool{selector: selector}
+	for _, u := range urls {
+		p.nodes = append(p.nodes, &node{url: strings.TrimRight(u, "/")})
+	}
+	return p
+}
+
+// pick 选择一个存活的节点，全部节点都不可用时仍然返回一个节点用于探测
+func (p *nodePool) pick() *node {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var alive []*node
+	for _, n := range p.nodes {
+		if n.alive() {
+			alive = append(alive, n)
+		}
+	}
+	if len(alive) == 0 {
+		alive = p.nodes
+	}
+	if p.selector == SelectorLeastLoaded {
+		best := alive[0]
+		for _, n := range alive[1:] {
+			if atomic.LoadInt64(&n.inflight) < atomic.LoadInt64(&best.inflight) {
+				best = n
+			}
+		}
+		return best
+	}
+	i := atomic.AddUint64(&p.next, 1)
+	return alive[int(i%uint64(len(alive)))]
+}
+
+func (p *nodePool) markDead(n *node) {
+	if atomic.CompareAndSwapInt32(&n.dead, 0, 1) {
+		log.Warnf("[ES] 节点 %v 不可用，暂时摘除", n.url)
+	}
+}
+
+func (p *nodePool) markAlive(n *node) {
+	if atomic.CompareAndSwapInt32(&n.dead, 1, 0) {
+		log.Infof("[ES] 节点 %v 恢复", n.url)
+	}
+}
+
+func (p *nodePool) deadNodes() []*node {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var dead []*node
+	for _, n := range p.nodes {
+		if !n.alive() {
+			dead = append(dead, n)
+		}
+	}
+	return dead
+}
+
+// replace 使用嗅探到的节点列表替换当前节点，保留已有节点的状态
+func (p *nodePool) replace(urls []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]*node)
+	for _, n := range p.nodes {
+		old[n.url] = n
+	}
+	var nodes []*node
+	for _, u := range urls {
+		if n, e := old[u]; e {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &node{url: u})
+		}
+	}
+	p.nodes = nodes
+}
+
+// 节点探测与嗅探的超时时间，不超过普通请求的超时
+const probeTimeout = 5 * time.Second
+
+// probeContext 返回节点探测与嗅探使用的 context
+func (c *Client) probeContext() (context.Context, context.CancelFunc) {
+	timeout := probeTimeout
+	if c.client.Timeout > 0 && c.client.Timeout < timeout {
+		timeout = c.client.Timeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// healthCheck 定期探测被摘除的节点
+func (c *Client) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+		for _, n := range c.pool.deadNodes() {
+			c.probe(n)
+		}
+	}
+}
+
+// probe 探测节点是否恢复，返回非 5xx 即视为恢复
+func (c *Client) probe(n *node) {
+	ctx, cancel := c.probeContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", n.url+"/", nil)
+	if err != nil {
+		return
+	}
+	c.authorize(req)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 500 {
+		c.pool.markAlive(n)
+	}
+}
+
+// sniff 定期通过 _nodes/http 获取集群中的全部 http 节点
+func (c *Client) sniff(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		ctx, cancel := c.probeContext()
+		_, body, err := c.requestContext(ctx, "GET", "/_nodes/http", nil)
+		cancel()
+		if err != nil {
+			log.Errorf("[ES] 嗅探节点失败... %v", err)
+		} else {
+			urls, err := parseNodes(body, c.conf.Scheme)
+			if err != nil {
+				log.Errorf("[ES] 嗅探节点失败... %v", err)
+			} else if len(urls) > 0 {
+				c.pool.replace(urls)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func parseNodes(body []byte, scheme string) ([]string, error) {
+	info := &struct {
+		Nodes map[string]struct {
+			Http struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}{}
+	err := json.Unmarshal(body, info)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, n := range info.Nodes {
+		addr := n.Http.PublishAddress
+		if addr == "" {
+			continue
+		}
+		// publish_address 可能是 hostname/ip:port 的形式
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr = addr[i+1:]
+		}
+		urls = append(urls, fmt.Sprintf("%v://%v", scheme, addr))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
@@ -0,0 +1,122 @@
+package es
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// breaker 连续失败达到阈值后熔断，熔断期间所有请求阻塞等待，到期后放行请求探测ES是否恢复
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	openTime  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) wait() {
+	for {
+		b.mu.Lock()
+		d := time.Until(b.openUntil)
+		b.mu.Unlock()
+		if d <= 0 {
+			return
+		}
+		time.Sleep(d)
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		log.Infof("[ES] 熔断恢复")
+	}
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.openTime)
+		log.Warnf("[ES] 连续失败 %v 次，熔断 %v", b.failures, b.openTime)
+	}
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsRetryable 网络错误以及ES过载、不可用时可以重试，其余错误（如 mapping 冲突、响应解析失败）重试也不会成功
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *ResponseError:
+		return retryableStatus(e.Status)
+	case *BulkError:
+		for _, item := range e.Items {
+			if retryableStatus(item.Status) {
+				return true
+			}
+		}
+		return false
+	case *ItemError:
+		return retryableStatus(e.Status)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// 发送请求失败时 http.Client 返回 *url.Error，解析地址失败时也是 *url.Error，但 Op 为 parse，重试不会成功
+	// *url.Error 同时实现了 net.Error，需要先判断
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Op != "parse"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retry 执行 fn，遇到可重试错误时按指数退避重试
+// 重试次数耗尽后熔断，如果配置了 BlockOnFailure 则一直阻塞重试直到ES恢复，从而反压 canal 而不是丢弃数据
+func (c *Client) retry(fn func() error) error {
+	backoff := time.Duration(c.conf.RetryInitialBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(c.conf.RetryMaxBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		c.breaker.wait()
+		err := fn()
+		if err == nil || !IsRetryable(err) {
+			c.breaker.success()
+			return err
+		}
+		c.breaker.failure()
+		if attempt >= c.conf.RetryMaxAttempts {
+			if !c.conf.BlockOnFailure {
+				return err
+			}
+			if attempt == c.conf.RetryMaxAttempts {
+				log.Errorf("[ES] 重试 %v 次仍然失败，阻塞等待ES恢复... %v", attempt, err)
+			}
+		} else {
+			log.Warnf("[ES] 第 %v 次请求失败，%v 后重试... %v", attempt, backoff, err)
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package es
+
+import (
+	"errors"
+	"fmt"
+	"go-mysql2es/src/config"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"429", &ResponseError{Status: 429}, true},
+		{"503", &ResponseError{Status: 503}, true},
+		{"400", &ResponseError{Status: 400}, false},
+		{"500", &ResponseError{Status: 500}, false},
+		{"bulk 429", &BulkError{Items: []*ItemError{{Status: 400}, {Status: 429}}}, true},
+		{"bulk 400", &BulkError{Items: []*ItemError{{Status: 400}}}, false},
+		{"item 502", &ItemError{Status: 502}, true},
+		{"item 409", &ItemError{Status: 409}, false},
+		{"eof", io.EOF, true},
+		{"wrapped eof", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"url", &url.Error{Op: "Post", URL: "http://es", Err: errors.New("connection reset")}, true},
+		{"url parse", &url.Error{Op: "parse", URL: "::", Err: errors.New("missing protocol scheme")}, false},
+		{"other", errors.New("other"), false},
+	}
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.want {
+			t.Fatalf("%v: IsRetryable = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func newRetryClient(maxAttempts int, blockOnFailure bool, threshold int, openTime time.Duration) *Client {
+	return &Client{
+		conf: &config.ESConf{
+			RetryMaxAttempts:      maxAttempts,
+			RetryInitialBackoffMs: 1,
+			RetryMaxBackoffMs:     1,
+			BlockOnFailure:        blockOnFailure,
+		},
+		breaker: &breaker{threshold: threshold, openTime: openTime},
+	}
+}
+
+// failTimes 前 n 次返回 err，之后成功
+func failTimes(n int, err error, calls *int) func() error {
+	return func() error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestRetrySucceedsAfterRetryableErrors(t *testing.T) {
+	c := newRetryClient(3, false, 100, time.Millisecond)
+	calls := 0
+	if err := c.retry(failTimes(2, &ResponseError{Status: 503}, &calls)); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if calls != 3 {
+		t.Fatalf("calls = %v, want 3", calls)
+	}
+}
+
+func TestRetryNonRetryable(t *testing.T) {
+	c := newRetryClient(3, true, 100, time.Millisecond)
+	calls := 0
+	err := c.retry(failTimes(10, &ResponseError{Status: 400}, &calls))
+	if re, ok := err.(*ResponseError); !ok || re.Status != 400 {
+		t.Fatalf("err = %v, want 400", err)
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %v, want 1", calls)
+	}
+}
+
+func TestRetryGivesUpWithoutBlockOnFailure(t *testing.T) {
+	c := newRetryClient(3, false, 100, time.Millisecond)
+	calls := 0
+	err := c.retry(failTimes(10, &ResponseError{Status: 429}, &calls))
+	if re, ok := err.(*ResponseError); !ok || re.Status != 429 {
+		t.Fatalf("err = %v, want 429", err)
+	}
+	if calls != 3 {
+		t.Fatalf("calls = %v, want 3", calls)
+	}
+}
+
+func TestRetryBlockOnFailure(t *testing.T) {
+	c := newRetryClient(2, true, 100, time.Millisecond)
+	calls := 0
+	// 超过重试次数后继续重试，直到成功
+	if err := c.retry(failTimes(6, &ResponseError{Status: 503}, &calls)); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if calls != 7 {
+		t.Fatalf("calls = %v, want 7", calls)
+	}
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	openTime := 50 * time.Millisecond
+	b := &breaker{threshold: 2, openTime: openTime}
+	b.failure()
+	start := time.Now()
+	b.wait()
+	if time.Since(start) >= openTime {
+		t.Fatal("breaker should not open before threshold")
+	}
+
+	b.failure()
+	start = time.Now()
+	b.wait()
+	if d := time.Since(start); d < openTime/2 {
+		t.Fatalf("breaker waited %v, want about %v", d, openTime)
+	}
+
+	b.success()
+	if b.failures != 0 {
+		t.Fatalf("failures = %v, want 0", b.failures)
+	}
+	// 恢复后再失败一次不会熔断
+	b.failure()
+	start = time.Now()
+	b.wait()
+	if time.Since(start) >= openTime {
+		t.Fatal("breaker should be closed after success")
+	}
+}
+
+func TestRetryWaitsForBreaker(t *testing.T) {
+	openTime := 50 * time.Millisecond
+	c := newRetryClient(5, false, 2, openTime)
+	calls := 0
+	start := time.Now()
+	if err := c.retry(failTimes(2, &ResponseError{Status: 503}, &calls)); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	// 连续失败两次后熔断，第三次请求要等熔断到期
+	if d := time.Since(start); d < openTime/2 {
+		t.Fatalf("retry took %v, want at least about %v", d, openTime)
+	}
+	if c.breaker.failures != 0 {
+		t.Fatalf("failures = %v, want 0", c.breaker.failures)
+	}
+}
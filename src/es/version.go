@@ -0,0 +1,87 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const distributionOpenSearch = "opensearch"
+
+// DetectVersion 确定集群版本，ES 7 及以上和 OpenSearch 使用 typeless 接口，ES 5/6 保持使用 type
+// 配置了 es.version 时直接使用配置，否则请求根路径自动识别
+func (c *Client) DetectVersion() error {
+	version := c.conf.Version
+	distribution := ""
+	if version == "" {
+		_, body, err := c.do("GET", "/", nil)
+		if err != nil {
+			return err
+		}
+		info := &struct {
+			Version struct {
+				Number       string `json:"number"`
+				Distribution string `json:"distribution"`
+			} `json:"version"`
+		}{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return fmt.Errorf("[ES] 解析版本信息失败 %v: %v", err, string(body))
+		}
+		version = info.Version.Number
+		distribution = info.Version.Distribution
+	} else if strings.EqualFold(version, distributionOpenSearch) {
+		distribution = distributionOpenSearch
+	}
+	if distribution == distributionOpenSearch {
+		// OpenSearch 接口与 ES 7 一致
+		c.typeless = true
+		c.major = 7
+		c.removeIndex = true
+	} else {
+		parts := strings.Split(version, ".")
+		major, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("[ES] 无法识别的版本 %v", version)
+		}
+		minor := 0
+		if len(parts) > 1 {
+			minor, _ = strconv.Atoi(parts[1])
+		}
+		c.major = major
+		c.unsignedLong = major > 7 || major == 7 && minor >= 10
+		c.removeIndex = major > 6 || major == 6 && minor >= 4
+		c.typeless = major >= 7
+		if !c.typeless && c.conf.Type == "" {
+			return fmt.Errorf("[ES] 版本 %v 需要配置 es.type", version)
+		}
+	}
+	log.Infof("[ES] version: %v %v typeless: %v", distribution, version, c.typeless)
+	return nil
+}
+
+func (c *Client) docPath(id interface{}) string {
+	docId := url.PathEscape(fmt.Sprintf("%v", id))
+	if c.typeless {
+		return fmt.Sprintf("/%v/_doc/%v", c.conf.Index, docId)
+	}
+	return fmt.Sprintf("/%v/%v/%v", c.conf.Index, c.conf.Type, docId)
+}
+
+func (c *Client) updatePath(id interface{}) string {
+	docId := url.PathEscape(fmt.Sprintf("%v", id))
+	if c.typeless {
+		return fmt.Sprintf("/%v/_update/%v", c.conf.Index, docId)
+	}
+	return fmt.Sprintf("/%v/%v/%v/_update", c.conf.Index, c.conf.Type, docId)
+}
+
+func (c *Client) bulkPath() string {
+	if c.typeless {
+		return fmt.Sprintf("/%v/_bulk", c.conf.Index)
+	}
+	return fmt.Sprintf("/%v/%v/_bulk", c.conf.Index, c.conf.Type)
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"sync"
+	"time"
+)
+
+// Checkpoint 记录已被ES确认写入的binlog位点
+// 每个 RowsEvent 对应一个 event，派发出的每个任务都会占用一次计数，只有计数归零后该 event 才算完成
+// canal 每次 OnPosSynced 会打一个标记，当标记之前的所有 event 都完成后，位点才会推进到该标记
+type Checkpoint struct {
+	mu        sync.Mutex
+	seq       uint64
+	events    []*event
+	marks     []mark
+	committed mysql.Position
+	// 第一个无法确认的写入错误，该 event 永远不会完成，出现后停止消费 binlog
+	err error
+}
+
+type event struct {
+	c       *Checkpoint
+	seq     uint64
+	pending int
+	// 该 event 在 binlog 中的位置，用于记录死信
+	pos   mysql.Position
+	begin time.Time
+}
+
+type mark struct {
+	seq uint64
+	pos mysql.Position
+}
+
+func NewCheckpoint(start mysql.Position) *Checkpoint {
+	return &Checkpoint{committed: start}
+}
+
+// Begin 开始一个新的 event，调用方处理完派发后必须调用一次 done
+func (c *Checkpoint) Begin(pos mysql.Position) *event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	ev := &event{c, c.seq, 1, pos, time.Now()}
+	c.events = append(c.events, ev)
+	return ev
+}
+
+// Mark 标记当前所有已开始的 event 完成后，可以安全地从 pos 恢复
+func (c *Checkpoint) Mark(pos mysql.Position) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marks = append(c.marks, mark{c.seq, pos})
+	c.advance()
+}
+
+// Position 返回已被完全确认的位点
+func (c *Checkpoint) Position() mysql.Position {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.committed
+}
+
+// Events 返回已开始的 event 总数，不变时说明没有新的 binlog 事件
+func (c *Checkpoint) Events() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// Pending 返回尚未被确认的 event 数量
+func (c *Checkpoint) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.events)
+}
+
+// Oldest 返回最早未确认的 event 的位置与已等待的时间，没有未确认的 event 时返回 false
+func (c *Checkpoint) Oldest() (mysql.Position, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.events) == 0 {
+		return mysql.Position{}, 0, false
+	}
+	ev := c.events[0]
+	return ev.pos, time.Since(ev.begin), true
+}
+
+// Fail 记录无法确认的写入错误，位点不会越过该 event，继续消费只会让未确认的 event 无限堆积
+func (c *Checkpoint) Fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Err 返回第一个无法确认的写入错误
+func (c *Checkpoint) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Checkpoint) advance() {
+	for len(c.events) > 0 && c.events[0].pending == 0 {
+		c.events = c.events[1:]
+	}
+	low := c.seq + 1
+	if len(c.events) > 0 {
+		low = c.events[0].seq
+	}
+	for len(c.marks) > 0 && c.marks[0].seq < low {
+		c.committed = c.marks[0].pos
+		c.marks = c.marks[1:]
+	}
+}
+
+func (ev *event) add(n int) {
+	ev.c.mu.Lock()
+	defer ev.c.mu.Unlock()
+	ev.pending += n
+}
+
+func (ev *event) done() {
+	ev.c.mu.Lock()
+	defer ev.c.mu.Unlock()
+	ev.pending--
+	if ev.pending == 0 {
+		ev.c.advance()
+	}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"errors"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"testing"
+)
+
+func pos(n uint32) mysql.Position {
+	return mysql.Position{Name: "mysql-bin.000001", Pos: n}
+}
+
+func assertPosition(t *testing.T, c *Checkpoint, want mysql.Position) {
+	t.Helper()
+	if got := c.Position(); got != want {
+		t.Fatalf("position = %v, want %v", got, want)
+	}
+}
+
+func TestCheckpointOutOfOrderDone(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	ev1 := c.Begin(pos(100))
+	ev2 := c.Begin(pos(200))
+	c.Mark(pos(300))
+
+	// 已完成的 event 在前面的 event 完成前仍然计入 Pending
+	ev2.done()
+	assertPosition(t, c, pos(4))
+	if c.Pending() != 2 {
+		t.Fatalf("pending = %v, want 2", c.Pending())
+	}
+
+	ev1.done()
+	assertPosition(t, c, pos(300))
+	if c.Pending() != 0 {
+		t.Fatalf("pending = %v, want 0", c.Pending())
+	}
+}
+
+func TestCheckpointMarksBetweenEvents(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	ev1 := c.Begin(pos(100))
+	c.Mark(pos(150))
+	ev2 := c.Begin(pos(200))
+	c.Mark(pos(250))
+
+	// 后一个 event 先完成时不能越过前一个 event 之前的标记
+	ev2.done()
+	assertPosition(t, c, pos(4))
+
+	ev1.done()
+	assertPosition(t, c, pos(250))
+}
+
+func TestCheckpointAdvancesToEarlierMark(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	ev1 := c.Begin(pos(100))
+	c.Mark(pos(150))
+	ev2 := c.Begin(pos(200))
+	c.Mark(pos(250))
+
+	ev1.done()
+	assertPosition(t, c, pos(150))
+
+	ev2.done()
+	assertPosition(t, c, pos(250))
+}
+
+func TestCheckpointWaitsForTasks(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	ev := c.Begin(pos(100))
+	// 派发出的两个任务各占用一次计数
+	ev.add(2)
+	ev.done()
+	c.Mark(pos(150))
+	assertPosition(t, c, pos(4))
+
+	ev.done()
+	assertPosition(t, c, pos(4))
+
+	ev.done()
+	assertPosition(t, c, pos(150))
+}
+
+func TestCheckpointMarkWithoutEvents(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	c.Mark(pos(50))
+	assertPosition(t, c, pos(50))
+
+	ev := c.Begin(pos(100))
+	ev.done()
+	assertPosition(t, c, pos(50))
+	c.Mark(pos(150))
+	assertPosition(t, c, pos(150))
+}
+
+func TestCheckpointOldest(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	if _, _, ok := c.Oldest(); ok {
+		t.Fatal("oldest should be empty")
+	}
+	ev1 := c.Begin(pos(100))
+	ev2 := c.Begin(pos(200))
+	if p, _, ok := c.Oldest(); !ok || p != pos(100) {
+		t.Fatalf("oldest = %v %v, want %v", p, ok, pos(100))
+	}
+	ev1.done()
+	if p, _, ok := c.Oldest(); !ok || p != pos(200) {
+		t.Fatalf("oldest = %v %v, want %v", p, ok, pos(200))
+	}
+	ev2.done()
+	if _, _, ok := c.Oldest(); ok {
+		t.Fatal("oldest should be empty")
+	}
+}
+
+func TestCheckpointFail(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	if c.Err() != nil {
+		t.Fatalf("err = %v, want nil", c.Err())
+	}
+	first := errors.New("first")
+	c.Fail(first)
+	c.Fail(errors.New("second"))
+	if c.Err() != first {
+		t.Fatalf("err = %v, want %v", c.Err(), first)
+	}
+}
+
+func TestCheckpointEvents(t *testing.T) {
+	c := NewCheckpoint(pos(4))
+	if c.Events() != 0 {
+		t.Fatalf("events = %v, want 0", c.Events())
+	}
+	c.Begin(pos(100)).done()
+	c.Mark(pos(150))
+	// 只有标记没有新的 event 时不变
+	c.Mark(pos(200))
+	if c.Events() != 1 {
+		t.Fatalf("events = %v, want 1", c.Events())
+	}
+}
@@ -6,25 +6,50 @@ import (
 	"github.com/go-mysql-org/go-mysql/canal"
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
 	log "github.com/sirupsen/logrus"
 	"go-mysql2es/src/config"
-	"go-mysql2es/src/db"
+	"go-mysql2es/src/dlq"
 	"go-mysql2es/src/es"
+	"reflect"
 )
 
+// MysqlQuerier 处理 binlog 时需要的 MySQL 查询，由 *db.DB 实现
+type MysqlQuerier interface {
+	RowData(collList map[string]*config.Coll, table *schema.Table, row []interface{}) map[*config.Coll]interface{}
+	GetMainIdsByJoinId(joinId interface{}, joinTableName string) [][]interface{}
+	GetJoinData(joinTable *config.JoinTable, joinValue interface{}) map[*config.Coll]interface{}
+	FullGetById(keys [][]interface{}) []map[*config.Coll]interface{}
+	RowKey(table *schema.Table, row []interface{}) []interface{}
+}
+
 type EsSyncHandler struct {
 	rule        *config.Rule
 	EsClient    *es.Client
-	MysqlClient *db.DB
+	MysqlClient MysqlQuerier
 	Stat        map[string]map[string]int64
+	Checkpoint  *Checkpoint
+	pool        *WorkerPool
+	deadLetter  *dlq.Writer
+	bulk        *es.BulkProcessor
+	binLogName  string
+	// 主表插入、更新直接使用 binlog 中的行数据，不再回查 MySQL
+	useRowImage bool
 }
 
-func New(rule *config.Rule, es *es.Client, db *db.DB) *EsSyncHandler {
-	h := &EsSyncHandler{rule, es, db, nil}
+func New(conf *config.Conf, es *es.Client, db MysqlQuerier, position mysql.Position, deadLetter *dlq.Writer) *EsSyncHandler {
+	h := &EsSyncHandler{conf.Rule, es, db, nil, NewCheckpoint(position), nil, deadLetter, es.NewBulkProcessor(), position.Name, conf.BinLogConf.UseRowImage}
+	h.pool = NewWorkerPool(conf.BinLogConf.WorkerCount, h.execute)
 	h.RefreshAndGetStat()
 	return h
 }
 
+// Close 等待已派发的任务执行完并写入ES，需要在 canal 停止之后调用，之后位点不会再变化
+func (h *EsSyncHandler) Close() {
+	h.pool.Close()
+	h.bulk.Close()
+}
+
 func (h *EsSyncHandler) RefreshAndGetStat() map[string]map[string]int64 {
 	old := h.Stat
 	stat := make(map[string]map[string]int64)
@@ -44,223 +69,349 @@ func (h *EsSyncHandler) RefreshAndGetStat() map[string]map[string]int64 {
 	return old
 }
 
-func (h *EsSyncHandler) rowsEventHandler(e *canal.RowsEvent) (affected int64, err error) {
+func (h *EsSyncHandler) rowsEventHandler(e *canal.RowsEvent, ev *event) (affected int64, err error) {
 	eventAction := e.Action
 	d, _ := json.Marshal(e.Rows)
 	fmt.Println(fmt.Sprintf("[%v] %v", eventAction, string(d)))
 	switch eventAction {
 	case canal.DeleteAction:
-		return h.deleteEventHandler(e)
+		return h.deleteEventHandler(e, ev)
 	case canal.UpdateAction:
-		return h.updateEventHandler(e)
+		return h.updateEventHandler(e, ev)
 	case canal.InsertAction:
-		return h.insertEventHandler(e)
+		return h.insertEventHandler(e, ev)
 	default:
 		return 0, nil
 	}
 }
 
-func (h *EsSyncHandler) insertEventHandler(e *canal.RowsEvent) (affected int64, err error) {
+func (h *EsSyncHandler) insertEventHandler(e *canal.RowsEvent, ev *event) (affected int64, err error) {
 	//主表插入：请求MYSQL查询所有结果 -> ES.UPSERT
-	//副表插入：拿到所有符合的数据重新查询
+	//副表插入：查出关联的主表ID，只更新副表字段
 	if e.Table.Name == h.rule.MainTable.TableName {
 		h.Stat[h.rule.MainTable.TableName]["i"]++
-		mainIndex := -1
-		for i, coll := range e.Table.Columns {
-			if coll.Name == h.rule.MainTable.MainCollName {
-				mainIndex = i
-				break
-			}
-		}
-		if mainIndex == -1 {
-			return 0, err
+		if h.useRowImage {
+			return h.dispatchRows(e, taskInsert, ev)
 		}
-		for _, row := range e.Rows {
-			id := row[mainIndex]
-			resultList := h.MysqlClient.FullGetById([]interface{}{id})
-			err := h.EsClient.BatchInsert(resultList)
-			if err != nil {
-				log.Error(err)
-			}
-			affected++
-		}
-	} else {
-		mainIndex := -1
-		joinTable := h.rule.JoinTables[e.Table.Name]
-		if joinTable == nil {
-			return 0, nil
-		}
-		h.Stat[joinTable.TableName]["i"]++
-		for i, coll := range e.Table.Columns {
-			if coll.Name == joinTable.JoinCollName {
-				mainIndex = i
-				break
-			}
-		}
-		if mainIndex == -1 {
-			return 0, err
+		return h.dispatchMain(e, taskInsert, ev)
+	}
+	joinTable := h.rule.JoinTables[e.Table.Name]
+	if joinTable == nil {
+		return 0, nil
+	}
+	h.Stat[joinTable.TableName]["i"]++
+	return h.dispatchPartial(e, joinTable, taskInsert, ev)
+}
+
+func (h *EsSyncHandler) deleteEventHandler(e *canal.RowsEvent, ev *event) (affected int64, err error) {
+	//主表删除：删除索引记录
+	//副表删除：关联主表文档中的副表字段置为 null
+	if e.Table.Name == h.rule.MainTable.TableName {
+		h.Stat[h.rule.MainTable.TableName]["d"]++
+		return h.dispatchMain(e, taskDelete, ev)
+	}
+	joinTable := h.rule.JoinTables[e.Table.Name]
+	if joinTable == nil {
+		return 0, nil
+	}
+	h.Stat[joinTable.TableName]["d"]++
+	return h.dispatchJoinDelete(e, joinTable, ev)
+}
+
+func (h *EsSyncHandler) updateEventHandler(e *canal.RowsEvent, ev *event) (affected int64, err error) {
+	//主表更新：查询MYSQL全量数据插入
+	//副表更新：连接字段未变化时只更新副表字段，否则重新查询新旧两边的数据
+	if e.Table.Name == h.rule.MainTable.TableName {
+		h.Stat[h.rule.MainTable.TableName]["u"]++
+		if h.useRowImage {
+			return h.dispatchRows(e, taskUpdate, ev)
 		}
-		ids := map[interface{}]bool{}
-		//update返回修改前与修改后两条数据，有可能并没有涉及ID的变化，所以ID相同的时候只需修改一条
+		return h.dispatchMain(e, taskUpdate, ev)
+	}
+	joinTable := h.rule.JoinTables[e.Table.Name]
+	if joinTable == nil {
+		return 0, nil
+	}
+	h.Stat[joinTable.TableName]["u"]++
+	return h.dispatchPartial(e, joinTable, taskUpdate, ev)
+}
+
+// dispatchMain 主表变更直接按主键分发
+func (h *EsSyncHandler) dispatchMain(e *canal.RowsEvent, action uint8, ev *event) (affected int64, err error) {
+	if !h.hasKey(e) {
+		return 0, nil
+	}
+	var keys [][]interface{}
+	if action != taskUpdate {
 		for _, row := range e.Rows {
-			ids[row[mainIndex]] = true
+			keys = append(keys, h.MysqlClient.RowKey(e.Table, row))
 		}
-		for id := range ids {
-			mainIds := h.MysqlClient.GetMainIdsByJoinId(id, joinTable.TableName)
-			if mainIds != nil && len(mainIds) != 0 {
-				resultList := h.MysqlClient.FullGetById(mainIds)
-				for _, result := range resultList {
-					err := h.EsClient.Upsert(result)
-					if err != nil {
-						log.Error(err)
-					}
-				}
-				affected++
+		h.pool.Dispatch(action, keys, ev)
+		return int64(len(keys)), nil
+	}
+	// update 事件的 Rows 为修改前、修改后交替排列，主键被修改时需要删除旧主键对应的文档
+	// 删除需要与前后的更新保持先后顺序（如 1 -> 2、2 -> 3），因此先投递之前积累的更新
+	for i := 1; i < len(e.Rows); i += 2 {
+		before, after := h.MysqlClient.RowKey(e.Table, e.Rows[i-1]), h.MysqlClient.RowKey(e.Table, e.Rows[i])
+		if !reflect.DeepEqual(before, after) {
+			if len(keys) != 0 {
+				h.pool.Dispatch(action, keys, ev)
+				affected += int64(len(keys))
+				keys = nil
 			}
+			h.pool.Dispatch(taskDelete, [][]interface{}{before}, ev)
 		}
+		keys = append(keys, after)
 	}
-	return affected, err
+	h.pool.Dispatch(action, keys, ev)
+	return affected + int64(len(keys)), nil
 }
 
-func (h *EsSyncHandler) deleteEventHandler(e *canal.RowsEvent) (affected int64, err error) {
-	//主表删除：删除索引记录
-	//副表插入：拿到所有符合的数据重新查询
-	if e.Table.Name == h.rule.MainTable.TableName {
-		h.Stat[h.rule.MainTable.TableName]["d"]++
-		mainIndex := -1
-		for i, coll := range e.Table.Columns {
-			if coll.Name == h.rule.MainTable.MainCollName {
-				mainIndex = i
-				break
+// dispatchRows 使用 binlog 中的行数据构建主表字段，插入时查询全部附表，更新时只在连接字段变化时查询对应的附表
+// update 事件的 Rows 为修改前、修改后交替排列
+func (h *EsSyncHandler) dispatchRows(e *canal.RowsEvent, action uint8, ev *event) (affected int64, err error) {
+	if !h.hasKey(e) {
+		return 0, nil
+	}
+	var rows []*rowChange
+	step := 1
+	if action == taskUpdate {
+		step = 2
+	}
+	for i := step - 1; i < len(e.Rows); i += step {
+		after := e.Rows[i]
+		change := &rowChange{h.MysqlClient.RowKey(e.Table, after), h.MysqlClient.RowData(h.rule.MainTable.CollList, e.Table, after), nil, action == taskInsert}
+		if action == taskUpdate {
+			// 主键被修改时删除旧文档，新文档需要完整写入
+			before := h.MysqlClient.RowKey(e.Table, e.Rows[i-1])
+			if !reflect.DeepEqual(before, change.key) {
+				// 与 dispatchMain 相同，先投递之前积累的变更再删除旧文档
+				if len(rows) != 0 {
+					h.pool.DispatchRows(action, rows, ev)
+					affected += int64(len(rows))
+					rows = nil
+				}
+				h.pool.Dispatch(taskDelete, [][]interface{}{before}, ev)
+				change.full = true
 			}
 		}
-		if mainIndex == -1 {
-			return 0, err
-		}
-		for _, row := range e.Rows {
-			id := row[mainIndex]
-			err := h.EsClient.Delete(id)
-			if err != nil {
-				log.Error(err)
+		// 连接字段（join_main_coll）被修改时重新查询对应的附表及其下级附表，新值没有匹配的行时附表字段写入 null
+		for _, joinTable := range h.rule.Children("") {
+			index := columnIndex(e, joinTable.MainCollName)
+			if index == -1 {
+				continue
+			}
+			if !change.full && reflect.DeepEqual(e.Rows[i-1][index], after[index]) {
+				continue
 			}
-			affected++
+			change.joins = append(change.joins, &rowJoin{joinTable, after[index]})
 		}
-	} else {
-		mainIndex := -1
-		joinTable := h.rule.JoinTables[e.Table.Name]
-		if joinTable == nil {
-			return 0, nil
+		rows = append(rows, change)
+	}
+	h.pool.DispatchRows(action, rows, ev)
+	return affected + int64(len(rows)), nil
+}
+
+// hasKey binlog 行中是否包含全部主键字段
+// 主键值通过 MysqlClient.RowKey 按查询结果的方式转换，删除与修改主键时生成的文档ID与写入时一致
+func (h *EsSyncHandler) hasKey(e *canal.RowsEvent) bool {
+	for _, name := range h.rule.MainTable.KeyCollNames {
+		if columnIndex(e, name) == -1 {
+			return false
 		}
-		h.Stat[joinTable.TableName]["d"]++
-		for i, coll := range e.Table.Columns {
-			if coll.Name == joinTable.JoinCollName {
-				mainIndex = i
-				break
-			}
+	}
+	return true
+}
+
+// dispatchJoinDelete 附表删除时将关联主表文档中的附表字段置为 null，与 LEFT JOIN 未匹配到时的结果一致
+// 一对多的附表则以剩余的行重新生成数组
+// 连接字段不唯一时附表中可能还有其他匹配的行，因此按连接字段重新查询一次附表，没有剩余的行时所有字段为 null
+func (h *EsSyncHandler) dispatchJoinDelete(e *canal.RowsEvent, joinTable *config.JoinTable, ev *event) (affected int64, err error) {
+	joinIndex := columnIndex(e, joinTable.JoinCollName)
+	if joinIndex == -1 {
+		return 0, nil
+	}
+	ids := map[interface{}]bool{}
+	for _, row := range e.Rows {
+		joinId := row[joinIndex]
+		//同一个连接字段只需处理一次
+		if ids[joinId] {
+			continue
 		}
-		if mainIndex == -1 {
-			return 0, err
+		ids[joinId] = true
+		mainKeys := h.MysqlClient.GetMainIdsByJoinId(joinId, joinTable.TableName)
+		if len(mainKeys) == 0 {
+			continue
 		}
-		ids := map[interface{}]bool{}
-		//update返回修改前与修改后两条数据，有可能并没有涉及ID的变化，所以ID相同的时候只需修改一条
-		for _, row := range e.Rows {
-			ids[row[mainIndex]] = true
+		h.pool.DispatchPartial(mainKeys, h.MysqlClient.GetJoinData(joinTable, joinId), ev)
+		affected++
+	}
+	return affected, nil
+}
+
+// dispatchPartial 附表插入、更新时只将附表字段局部更新到关联的主表文档，避免回查整行宽表
+// 附表字段取自 binlog 行数据（需要完整行镜像），否则按连接字段查询一次附表（连同其下级附表）
+// 多级连接时关联的主表ID沿上级附表逐级查询
+// 更新了连接字段时关联的主表发生变化，退回到重新查询新旧两边的主表数据
+func (h *EsSyncHandler) dispatchPartial(e *canal.RowsEvent, joinTable *config.JoinTable, action uint8, ev *event) (affected int64, err error) {
+	joinIndex := columnIndex(e, joinTable.JoinCollName)
+	if joinIndex == -1 {
+		return 0, nil
+	}
+	step := 1
+	if action == taskUpdate {
+		step = 2
+	}
+	for i := step - 1; i < len(e.Rows); i += step {
+		after := e.Rows[i]
+		if action == taskUpdate && !reflect.DeepEqual(e.Rows[i-1][joinIndex], after[joinIndex]) {
+			affected += h.refreshByJoinId(e.Rows[i-1][joinIndex], joinTable, ev)
+			affected += h.refreshByJoinId(after[joinIndex], joinTable, ev)
+			continue
 		}
-		for id := range ids {
-			mainIds := h.MysqlClient.GetMainIdsByJoinId(id, joinTable.TableName)
-			if mainIds != nil && len(mainIds) != 0 {
-				resultList := h.MysqlClient.FullGetById(mainIds)
-				for _, result := range resultList {
-					err := h.EsClient.Upsert(result)
-					if err != nil {
-						log.Error(err)
-					}
-				}
-				affected++
-			}
+		mainKeys := h.MysqlClient.GetMainIdsByJoinId(after[joinIndex], joinTable.TableName)
+		if len(mainKeys) == 0 {
+			continue
+		}
+		// 有下级附表时需要连带查询下级附表的字段，一对多的附表需要查询全部行重新生成数组
+		var data map[*config.Coll]interface{}
+		if h.useRowImage && !joinTable.Many && len(h.rule.Children(joinTable.TableName)) == 0 {
+			data = h.MysqlClient.RowData(joinTable.CollList, e.Table, after)
+		} else {
+			data = h.MysqlClient.GetJoinData(joinTable, after[joinIndex])
 		}
+		h.pool.DispatchPartial(mainKeys, data, ev)
+		affected++
 	}
-	return affected, err
+	return affected, nil
 }
 
-func (h *EsSyncHandler) updateEventHandler(e *canal.RowsEvent) (affected int64, err error) {
-	//主表更新：查询MYSQL全量数据插入
-	//副表插入：拿到所有符合的数据重新查询
-	if e.Table.Name == h.rule.MainTable.TableName {
-		h.Stat[h.rule.MainTable.TableName]["u"]++
-		mainIndex := -1
-		for i, coll := range e.Table.Columns {
-			if coll.Name == h.rule.MainTable.MainCollName {
-				mainIndex = i
-				break
-			}
+// refreshByJoinId 重新查询连接字段为 joinId 的全部主表数据
+func (h *EsSyncHandler) refreshByJoinId(joinId interface{}, joinTable *config.JoinTable, ev *event) int64 {
+	mainKeys := h.MysqlClient.GetMainIdsByJoinId(joinId, joinTable.TableName)
+	if len(mainKeys) == 0 {
+		return 0
+	}
+	h.pool.Dispatch(taskRefresh, mainKeys, ev)
+	return 1
+}
+
+// execute 在 worker 协程内执行，同一ID的任务严格按投递顺序执行，返回错误时该任务不会被确认
+func (h *EsSyncHandler) execute(t *task) error {
+	switch t.action {
+	case taskDelete:
+		for _, key := range t.keys {
+			h.submit(t.ev, &es.Action{Op: es.OpDelete, Id: h.rule.MainTable.DocId(key)})
 		}
-		if mainIndex == -1 {
-			return 0, err
+	case taskPartial:
+		for _, key := range t.keys {
+			h.submit(t.ev, h.EsClient.PartialAction(key, t.data))
 		}
-		for _, row := range e.Rows {
-			id := row[mainIndex]
-			resultList := h.MysqlClient.FullGetById([]interface{}{id})
-			for _, result := range resultList {
-				err := h.EsClient.Upsert(result)
-				if err != nil {
-					log.Error(err)
-				}
-			}
-			affected++
+	case taskInsert, taskUpdate, taskRefresh:
+		if t.rows != nil {
+			h.executeRows(t)
+			return nil
 		}
-	} else {
-		mainIndex := -1
-		joinTable := h.rule.JoinTables[e.Table.Name]
-		if joinTable == nil {
-			return 0, nil
+		resultList := h.MysqlClient.FullGetById(t.keys)
+		for _, result := range resultList {
+			h.submit(t.ev, h.EsClient.IndexAction(result))
 		}
-		h.Stat[joinTable.TableName]["u"]++
-		for i, coll := range e.Table.Columns {
-			if coll.Name == joinTable.JoinCollName {
-				mainIndex = i
-				break
-			}
+	}
+	return nil
+}
+
+// executeRows 补齐需要的附表字段后写入，插入（以及修改了主键的更新）为完整文档覆盖写入，其余更新为局部更新
+func (h *EsSyncHandler) executeRows(t *task) {
+	for _, change := range t.rows {
+		data := h.joinedData(change)
+		if change.full {
+			h.submit(t.ev, h.EsClient.IndexAction(data))
+		} else {
+			h.submit(t.ev, h.EsClient.UpdateAction(data))
 		}
-		if mainIndex == -1 {
-			return 0, err
+	}
+}
+
+// joinedData 将重新查询的附表字段合并到行数据中，没有匹配的附表行时附表字段为 null
+func (h *EsSyncHandler) joinedData(change *rowChange) map[*config.Coll]interface{} {
+	data := change.data
+	for _, join := range change.joins {
+		for coll, v := range h.MysqlClient.GetJoinData(join.table, join.value) {
+			data[coll] = v
 		}
-		ids := map[interface{}]bool{}
-		//update返回修改前与修改后两条数据，有可能并没有涉及ID的变化，所以ID相同的时候只需修改一条
-		for _, row := range e.Rows {
-			ids[row[mainIndex]] = true
+	}
+	return data
+}
+
+// submit 将操作放入 bulk 缓冲，写入被确认后才释放 event 的计数
+// 单条文档不可重试的失败（如 mapping 冲突）写入死信文件后视为已处理；
+// 整个请求失败（如认证过期、索引被删除、请求体过大）与文档无关，不确认，位点停留在该 event 之前并停止消费 binlog
+func (h *EsSyncHandler) submit(ev *event, a *es.Action) {
+	ev.add(1)
+	h.bulk.Add(a, func(err error) {
+		if itemErr, ok := err.(*es.ItemError); ok && !es.IsRetryable(itemErr) {
+			err = h.writeDeadLetter(ev, a, err)
 		}
-		for id := range ids {
-			mainIds := h.MysqlClient.GetMainIdsByJoinId(id, joinTable.TableName)
-			if mainIds != nil && len(mainIds) != 0 {
-				resultList := h.MysqlClient.FullGetById(mainIds)
-				for _, result := range resultList {
-					err := h.EsClient.Upsert(result)
-					if err != nil {
-						log.Error(err)
-					}
-				}
-				affected++
-			}
+		if err != nil {
+			log.Errorf("[BULK] %v %v 写入失败，位点停止推进... %v", a.Op, a.Id, err)
+			h.Checkpoint.Fail(fmt.Errorf("[BULK] %v %v 写入失败, %v", a.Op, a.Id, err))
+			return
+		}
+		ev.done()
+	})
+}
+
+func (h *EsSyncHandler) writeDeadLetter(ev *event, a *es.Action, cause error) error {
+	if h.deadLetter == nil {
+		return cause
+	}
+	log.Errorf("[DLQ] %v %v 写入死信文件... %v", a.Op, a.Id, cause)
+	return h.deadLetter.Write(&dlq.Record{
+		Id:       fmt.Sprintf("%v", a.Id),
+		Action:   a.Op,
+		Doc:      a.Doc,
+		Upsert:   a.Upsert,
+		BinLog:   ev.pos.Name,
+		Position: ev.pos.Pos,
+		Error:    cause.Error(),
+	})
+}
+
+func columnIndex(e *canal.RowsEvent, collName string) int {
+	for i, coll := range e.Table.Columns {
+		if coll.Name == collName {
+			return i
 		}
 	}
-	return affected, err
+	return -1
 }
 
-func (h *EsSyncHandler) OnRotate(*replication.RotateEvent) error          { return nil }
+func (h *EsSyncHandler) OnRotate(e *replication.RotateEvent) error {
+	h.binLogName = string(e.NextLogName)
+	return nil
+}
 func (h *EsSyncHandler) OnTableChanged(schema string, table string) error { return nil }
 func (h *EsSyncHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
 	return nil
 }
 func (h *EsSyncHandler) OnRow(e *canal.RowsEvent) error {
-	_, err := h.rowsEventHandler(e)
+	// 有写入无法确认时停止 canal，重启后从已确认的位点重新消费
+	if err := h.Checkpoint.Err(); err != nil {
+		return err
+	}
+	ev := h.Checkpoint.Begin(mysql.Position{Name: h.binLogName, Pos: e.Header.LogPos})
+	defer ev.done()
+	_, err := h.rowsEventHandler(e, ev)
 	if err != nil {
 		log.Error(err)
 	}
 	return nil
 }
-func (h *EsSyncHandler) OnXID(mysql.Position) error                            { return nil }
-func (h *EsSyncHandler) OnGTID(mysql.GTIDSet) error                            { return nil }
-func (h *EsSyncHandler) OnPosSynced(mysql.Position, mysql.GTIDSet, bool) error { return nil }
+func (h *EsSyncHandler) OnXID(mysql.Position) error { return nil }
+func (h *EsSyncHandler) OnGTID(mysql.GTIDSet) error { return nil }
+func (h *EsSyncHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	h.Checkpoint.Mark(pos)
+	return nil
+}
 
 func (h *EsSyncHandler) String() string { return "RevertEventHandler" }
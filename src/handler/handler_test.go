@@ -0,0 +1,390 @@
+package handler
+
+import (
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"go-mysql2es/src/config"
+	"go-mysql2es/src/dlq"
+	"go-mysql2es/src/es"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMysql 按连接字段保存附表中剩余的行，查询结果与 LEFT JOIN ... LIMIT 1 一致
+type fakeMysql struct {
+	rule *config.Rule
+	// 附表名 -> 连接字段的值 -> 剩余的行
+	joinRows map[string]map[interface{}][]map[string]interface{}
+	// 附表名 -> 连接字段的值 -> 关联的主表主键
+	mainIds map[string]map[interface{}][][]interface{}
+	// GetJoinData 收到的连接字段的值
+	joinValues []interface{}
+	// 模拟 RowKey 对主键值的转换，为空时原样返回
+	convertKey func(v interface{}) interface{}
+}
+
+func (f *fakeMysql) RowData(collList map[string]*config.Coll, table *schema.Table, row []interface{}) map[*config.Coll]interface{} {
+	result := make(map[*config.Coll]interface{})
+	for i, column := range table.Columns {
+		if coll, e := collList[column.Name]; e {
+			result[coll] = row[i]
+		}
+	}
+	return result
+}
+
+func (f *fakeMysql) GetMainIdsByJoinId(joinId interface{}, joinTableName string) [][]interface{} {
+	return f.mainIds[joinTableName][joinId]
+}
+
+func (f *fakeMysql) GetJoinData(joinTable *config.JoinTable, joinValue interface{}) map[*config.Coll]interface{} {
+	f.joinValues = append(f.joinValues, joinValue)
+	result := make(map[*config.Coll]interface{})
+	for _, coll := range joinTable.CollList {
+		result[coll] = nil
+	}
+	if rows := f.joinRows[joinTable.TableName][joinValue]; len(rows) > 0 {
+		for name, v := range rows[0] {
+			result[joinTable.CollList[name]] = v
+		}
+	}
+	return result
+}
+
+func (f *fakeMysql) FullGetById(keys [][]interface{}) []map[*config.Coll]interface{} {
+	return nil
+}
+
+func (f *fakeMysql) RowKey(table *schema.Table, row []interface{}) []interface{} {
+	var key []interface{}
+	for _, name := range f.rule.MainTable.KeyCollNames {
+		v := row[table.FindColumn(name)]
+		if f.convertKey != nil {
+			v = f.convertKey(v)
+		}
+		key = append(key, v)
+	}
+	return key
+}
+
+// goods(id, title, shop_id) LEFT JOIN shop(id, name) ON goods.shop_id = shop.id，shop_id 未配置同步
+func testRule() *config.Rule {
+	goods := &config.MainTable{
+		TableName: "goods",
+		CollList: map[string]*config.Coll{
+			"id":    {CollName: "id", MappingName: "id", FullName: "goods.id"},
+			"title": {CollName: "title", MappingName: "title", FullName: "goods.title"},
+		},
+		KeyCollNames: []string{"id"},
+	}
+	shop := &config.JoinTable{
+		TableName: "shop",
+		CollList: map[string]*config.Coll{
+			"name": {CollName: "name", MappingName: "shop_name", FullName: "shop.name"},
+		},
+		JoinCollName: "id",
+		MainCollName: "shop_id",
+	}
+	return &config.Rule{JoinTables: map[string]*config.JoinTable{"shop": shop}, MainTable: goods}
+}
+
+func newTestHandler(f *fakeMysql) *EsSyncHandler {
+	h := &EsSyncHandler{rule: f.rule, MysqlClient: f, Checkpoint: NewCheckpoint(mysql.Position{}), useRowImage: true}
+	// 不启动 worker，直接从队列中取出投递的任务
+	h.pool = &WorkerPool{queues: []chan *task{make(chan *task, 16)}}
+	h.RefreshAndGetStat()
+	return h
+}
+
+func drain(h *EsSyncHandler) []*task {
+	var tasks []*task
+	for {
+		select {
+		case t := <-h.pool.queues[0]:
+			tasks = append(tasks, t)
+		default:
+			return tasks
+		}
+	}
+}
+
+func rowsEvent(table string, columns []string, action string, rows ...[]interface{}) *canal.RowsEvent {
+	t := &schema.Table{Schema: "test", Name: table}
+	for _, name := range columns {
+		t.Columns = append(t.Columns, schema.TableColumn{Name: name})
+	}
+	return &canal.RowsEvent{Table: t, Action: action, Rows: rows}
+}
+
+func TestJoinDeleteSetsNull(t *testing.T) {
+	rule := testRule()
+	f := &fakeMysql{
+		rule:    rule,
+		mainIds: map[string]map[interface{}][][]interface{}{"shop": {int64(1): {{int64(10)}, {int64(11)}}}},
+	}
+	h := newTestHandler(f)
+	ev := h.Checkpoint.Begin(mysql.Position{})
+	e := rowsEvent("shop", []string{"id", "name"}, canal.DeleteAction, []interface{}{int64(1), "a"})
+	_, err := h.rowsEventHandler(e, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := drain(h)
+	if len(tasks) != 1 || tasks[0].action != taskPartial {
+		t.Fatalf("tasks = %v, want one partial update", tasks)
+	}
+	if !reflect.DeepEqual(tasks[0].keys, [][]interface{}{{int64(10)}, {int64(11)}}) {
+		t.Fatalf("keys = %v", tasks[0].keys)
+	}
+	name := rule.JoinTables["shop"].CollList["name"]
+	if v, e := tasks[0].data[name]; !e || v != nil {
+		t.Fatalf("shop.name = %v %v, want null", v, e)
+	}
+}
+
+func TestJoinDeleteKeepsRemainingRow(t *testing.T) {
+	rule := testRule()
+	// 连接字段不唯一，删除一行后仍有一行匹配
+	f := &fakeMysql{
+		rule:     rule,
+		mainIds:  map[string]map[interface{}][][]interface{}{"shop": {int64(1): {{int64(10)}}}},
+		joinRows: map[string]map[interface{}][]map[string]interface{}{"shop": {int64(1): {{"name": "b"}}}},
+	}
+	h := newTestHandler(f)
+	ev := h.Checkpoint.Begin(mysql.Position{})
+	// 同一个连接字段的多行只处理一次
+	e := rowsEvent("shop", []string{"id", "name"}, canal.DeleteAction,
+		[]interface{}{int64(1), "a"}, []interface{}{int64(1), "c"})
+	_, err := h.rowsEventHandler(e, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := drain(h)
+	if len(tasks) != 1 {
+		t.Fatalf("tasks = %v, want 1", len(tasks))
+	}
+	name := rule.JoinTables["shop"].CollList["name"]
+	if tasks[0].data[name] != "b" {
+		t.Fatalf("shop.name = %v, want b", tasks[0].data[name])
+	}
+}
+
+func TestMainUpdateRequeriesChangedJoin(t *testing.T) {
+	rule := testRule()
+	f := &fakeMysql{rule: rule}
+	h := newTestHandler(f)
+	ev := h.Checkpoint.Begin(mysql.Position{})
+	columns := []string{"id", "title", "shop_id"}
+	e := rowsEvent("goods", columns, canal.UpdateAction,
+		// shop_id 1 -> 2
+		[]interface{}{int64(10), "a", int64(1)}, []interface{}{int64(10), "b", int64(2)},
+		// 只修改了 title
+		[]interface{}{int64(11), "c", int64(3)}, []interface{}{int64(11), "d", int64(3)})
+	_, err := h.rowsEventHandler(e, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := drain(h)
+	if len(tasks) != 1 || tasks[0].action != taskUpdate || len(tasks[0].rows) != 2 {
+		t.Fatalf("tasks = %v, want one update with two rows", tasks)
+	}
+	changed, unchanged := tasks[0].rows[0], tasks[0].rows[1]
+	if changed.full || len(changed.joins) != 1 || changed.joins[0].table != rule.JoinTables["shop"] {
+		t.Fatalf("changed row = %+v, want partial update requerying shop", changed)
+	}
+	// shop_id 没有配置同步，连接字段的值取自 binlog 行
+	if changed.joins[0].value != int64(2) {
+		t.Fatalf("join value = %v, want 2", changed.joins[0].value)
+	}
+	if len(unchanged.joins) != 0 {
+		t.Fatalf("unchanged row joins = %v, want none", unchanged.joins)
+	}
+
+	// 新值没有匹配的附表行时附表字段写入 null
+	data := h.joinedData(changed)
+	if !reflect.DeepEqual(f.joinValues, []interface{}{int64(2)}) {
+		t.Fatalf("join values = %v, want [2]", f.joinValues)
+	}
+	name := rule.JoinTables["shop"].CollList["name"]
+	if v, e := data[name]; !e || v != nil {
+		t.Fatalf("shop.name = %v %v, want null", v, e)
+	}
+	if data[rule.MainTable.CollList["title"]] != "b" {
+		t.Fatalf("title = %v, want b", data[rule.MainTable.CollList["title"]])
+	}
+}
+
+func TestMainKeyChangeUsesConvertedKeys(t *testing.T) {
+	rule := testRule()
+	// 模拟 DATETIME 主键，binlog 中的值与查询结果的格式不同
+	f := &fakeMysql{rule: rule, convertKey: func(v interface{}) interface{} {
+		return strings.Replace(v.(string), " ", "T", 1)
+	}}
+	h := newTestHandler(f)
+	h.useRowImage = false
+	ev := h.Checkpoint.Begin(mysql.Position{})
+	e := rowsEvent("goods", []string{"id", "title"}, canal.UpdateAction,
+		[]interface{}{"2021-01-02 15:04:05", "a"}, []interface{}{"2021-01-03 15:04:05", "a"})
+	_, err := h.rowsEventHandler(e, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := drain(h)
+	if len(tasks) != 2 || tasks[0].action != taskDelete || tasks[1].action != taskUpdate {
+		t.Fatalf("tasks = %v, want delete then update", tasks)
+	}
+	// 删除旧文档使用的主键与写入时的文档ID一致
+	if !reflect.DeepEqual(tasks[0].keys, [][]interface{}{{"2021-01-02T15:04:05"}}) {
+		t.Fatalf("delete keys = %v", tasks[0].keys)
+	}
+	if !reflect.DeepEqual(tasks[1].keys, [][]interface{}{{"2021-01-03T15:04:05"}}) {
+		t.Fatalf("update keys = %v", tasks[1].keys)
+	}
+
+	ev = h.Checkpoint.Begin(mysql.Position{})
+	e = rowsEvent("goods", []string{"id", "title"}, canal.DeleteAction, []interface{}{"2021-01-03 15:04:05", "a"})
+	_, err = h.rowsEventHandler(e, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks = drain(h)
+	if len(tasks) != 1 || tasks[0].action != taskDelete || !reflect.DeepEqual(tasks[0].keys, [][]interface{}{{"2021-01-03T15:04:05"}}) {
+		t.Fatalf("tasks = %+v, want delete of the converted key", tasks)
+	}
+}
+
+// newTestEs 启动一个只处理 _bulk 的ES，返回对应的客户端与 bulk 缓冲
+func newTestEs(t *testing.T, rule *config.Rule, status int, body string) (*es.Client, *es.BulkProcessor) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	conf := &config.Conf{Rule: rule, ES: &config.ESConf{
+		Nodes:                 []string{server.URL},
+		NodeSelector:          "roundRobin",
+		HealthCheckIntervalMs: 60000,
+		Index:                 "test",
+		Version:               "7.10.0",
+		RetryMaxAttempts:      1,
+		RetryInitialBackoffMs: 1,
+		RetryMaxBackoffMs:     1,
+		BreakerThreshold:      100,
+		BreakerOpenMs:         1,
+		BulkMaxActions:        100,
+		BulkMaxBytes:          1 << 20,
+		BulkFlushIntervalMs:   60000,
+	}}
+	client := es.New(conf)
+	if err := client.DetectVersion(); err != nil {
+		t.Fatal(err)
+	}
+	return client, client.NewBulkProcessor()
+}
+
+// submitPartial 模拟一次附表变更：派发、执行局部更新并刷新 bulk，等待写入被确认或失败
+func submitPartial(t *testing.T, h *EsSyncHandler) {
+	t.Helper()
+	ev := h.Checkpoint.Begin(pos(100))
+	name := h.rule.JoinTables["shop"].CollList["name"]
+	err := h.execute(&task{action: taskPartial, keys: [][]interface{}{{int64(10)}}, data: map[*config.Coll]interface{}{name: "a"}, ev: ev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.done()
+	h.Checkpoint.Mark(pos(150))
+	h.bulk.Flush()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Checkpoint.Position() != pos(150) && h.Checkpoint.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("bulk 写入超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPartialUpdateMissingDocument(t *testing.T) {
+	rule := testRule()
+	h := newTestHandler(&fakeMysql{rule: rule})
+	h.EsClient, h.bulk = newTestEs(t, rule, http.StatusOK,
+		`{"errors":true,"items":[{"update":{"_id":"10","status":404,"error":{"type":"document_missing_exception","reason":"[10]: document missing"}}}]}`)
+	path := filepath.Join(t.TempDir(), "test.dlq")
+	deadLetter, err := dlq.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.deadLetter = deadLetter
+
+	// 主表文档还没有写入，局部更新视为成功，不写入死信文件
+	submitPartial(t, h)
+	if err := h.Checkpoint.Err(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	records, err := dlq.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("dead letters = %v, want none", len(records))
+	}
+}
+
+func TestPartialUpdateItemFailure(t *testing.T) {
+	rule := testRule()
+	h := newTestHandler(&fakeMysql{rule: rule})
+	h.EsClient, h.bulk = newTestEs(t, rule, http.StatusOK,
+		`{"errors":true,"items":[{"update":{"_id":"10","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`)
+	path := filepath.Join(t.TempDir(), "test.dlq")
+	deadLetter, err := dlq.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.deadLetter = deadLetter
+
+	// 单条文档的失败写入死信文件后位点继续推进
+	submitPartial(t, h)
+	if err := h.Checkpoint.Err(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	records, err := dlq.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Id != "10" || records[0].Action != es.OpUpdate {
+		t.Fatalf("dead letters = %+v, want update 10", records)
+	}
+}
+
+func TestRequestFailureStopsCheckpoint(t *testing.T) {
+	rule := testRule()
+	h := newTestHandler(&fakeMysql{rule: rule})
+	h.EsClient, h.bulk = newTestEs(t, rule, http.StatusUnauthorized, `{"error":"api key expired"}`)
+	path := filepath.Join(t.TempDir(), "test.dlq")
+	deadLetter, err := dlq.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.deadLetter = deadLetter
+
+	// 整个请求失败与文档无关，不写入死信文件，位点停止推进
+	submitPartial(t, h)
+	if h.Checkpoint.Err() == nil {
+		t.Fatal("err = nil, want request failure")
+	}
+	if h.Checkpoint.Position() == pos(150) {
+		t.Fatal("position should not advance")
+	}
+	records, err := dlq.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("dead letters = %v, want none", len(records))
+	}
+}
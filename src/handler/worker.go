@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go-mysql2es/src/config"
+	"go-mysql2es/src/utils"
+	"sync"
+)
+
+const (
+	taskInsert uint8 = iota
+	taskUpdate
+	taskDelete
+	taskRefresh
+	// 附表变更只更新附表字段
+	taskPartial
+)
+
+// task 是分发给 worker 的最小执行单元，keys 中的主表主键必然落在同一个 worker 上
+type task struct {
+	action uint8
+	keys   [][]interface{}
+	// 使用 binlog 行数据时每个主键对应的变更，此时 keys 为空
+	rows []*rowChange
+	// taskPartial 时所有主键共用的附表字段
+	data map[*config.Coll]interface{}
+	ev   *event
+}
+
+// rowChange binlog 中一行主表数据转换后的字段，joins 为需要重新查询的附表
+type rowChange struct {
+	key   []interface{}
+	data  map[*config.Coll]interface{}
+	joins []*rowJoin
+	// 完整写入文档，否则为局部更新
+	full bool
+}
+
+// rowJoin 需要重新查询的附表，value 为 binlog 行中主表连接字段的值，该字段不一定配置了同步
+type rowJoin struct {
+	table *config.JoinTable
+	value interface{}
+}
+
+// WorkerPool 按主表主键 hash 分片，保证同一ID的变更顺序执行，不同ID之间并发执行
+type WorkerPool struct {
+	queues []chan *task
+	exec   func(t *task) error
+	wg     sync.WaitGroup
+}
+
+func NewWorkerPool(size int, exec func(t *task) error) *WorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &WorkerPool{queues: make([]chan *task, size), exec: exec}
+	for i := range p.queues {
+		p.queues[i] = make(chan *task, 1024)
+		p.wg.Add(1)
+		go p.run(i)
+	}
+	return p
+}
+
+// Close 关闭所有队列并等待已投递的任务执行完，之后不能再投递任务
+func (p *WorkerPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) run(i int) {
+	defer p.wg.Done()
+	for t := range p.queues[i] {
+		err := p.exec(t)
+		if err != nil {
+			// 失败的任务不确认，位点将停留在该 event 之前，重启后会从此处重新消费
+			log.Errorf("[WORKER] 执行任务失败，位点暂停推进 %v %v", t.keys, err)
+			continue
+		}
+		t.ev.done()
+	}
+	log.Infof("[WORKER] worker %v 退出", i)
+}
+
+func (p *WorkerPool) shard(key []interface{}) int {
+	return utils.GetHashFromStr(fmt.Sprintf("%v", key)) % len(p.queues)
+}
+
+// Dispatch 将一批主键按分片拆成多个任务投递，队列满时阻塞，从而反压 canal
+func (p *WorkerPool) Dispatch(action uint8, keys [][]interface{}, ev *event) {
+	p.dispatch(action, keys, nil, ev)
+}
+
+// DispatchPartial 将附表字段的局部更新按主键分片投递
+func (p *WorkerPool) DispatchPartial(keys [][]interface{}, data map[*config.Coll]interface{}, ev *event) {
+	p.dispatch(taskPartial, keys, data, ev)
+}
+
+func (p *WorkerPool) dispatch(action uint8, keys [][]interface{}, data map[*config.Coll]interface{}, ev *event) {
+	shards := make(map[int][][]interface{})
+	var order []int
+	for _, key := range keys {
+		i := p.shard(key)
+		if _, e := shards[i]; !e {
+			order = append(order, i)
+		}
+		shards[i] = append(shards[i], key)
+	}
+	for _, i := range order {
+		ev.add(1)
+		p.queues[i] <- &task{action, shards[i], nil, data, ev}
+	}
+}
+
+// DispatchRows 与 Dispatch 相同，按主键分片投递带有行数据的变更
+func (p *WorkerPool) DispatchRows(action uint8, rows []*rowChange, ev *event) {
+	shards := make(map[int][]*rowChange)
+	var order []int
+	for _, row := range rows {
+		i := p.shard(row.key)
+		if _, e := shards[i]; !e {
+			order = append(order, i)
+		}
+		shards[i] = append(shards[i], row)
+	}
+	for _, i := range order {
+		ev.add(1)
+		p.queues[i] <- &task{action, nil, shards[i], nil, ev}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"go-mysql2es/src/config"
 	"go-mysql2es/src/core"
 	"go-mysql2es/src/utils"
+	"os"
 	"time"
 )
 
@@ -23,15 +24,21 @@ func configLocalFilesystemLogger(filePath string) {
 		rotatelogs.WithRotationCount(3),
 	)
 	if err != nil {
-		log.Panicf("Init log failed, err:", err)
+		log.Panicf("Init log failed, err: %v", err)
 	}
 	log.SetOutput(writer)
 	log.SetLevel(log.InfoLevel)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
 	var confPath = flag.String("conf", "", "配置文件路径")
 	var logPath = flag.String("log", "", "日志路径")
+	var reindex = flag.Bool("reindex", false, "在新的版本索引中重建数据，完成后切换别名")
+	var deleteOld = flag.Bool("deleteOld", false, "重建完成后删除旧索引")
 	flag.Parse()
 	if *confPath == "" {
 		log.Panic("-conf 配置文件路径")
@@ -48,5 +55,26 @@ func main() {
 	conf := config.Load(confPath)
 	syncer := core.New(conf)
 	syncer.Prepare()
-	syncer.Run()
+	if *reindex {
+		syncer.Reindex(*deleteOld)
+	} else {
+		syncer.Run()
+	}
+}
+
+// replay 子命令：go-mysql2es replay -conf 配置文件路径 -file 死信文件路径
+func replay(args []string) {
+	flagSet := flag.NewFlagSet("replay", flag.ExitOnError)
+	var confPath = flagSet.String("conf", "", "配置文件路径")
+	var filePath = flagSet.String("file", "", "死信文件路径")
+	_ = flagSet.Parse(args)
+	if *confPath == "" {
+		log.Panic("-conf 配置文件路径")
+	}
+	if !utils.IsFile(*filePath) {
+		log.Panicf("-file 死信文件 %v 不存在", *filePath)
+	}
+	conf := config.Load(confPath)
+	syncer := core.New(conf)
+	syncer.Replay(*filePath)
 }
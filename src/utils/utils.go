@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
@@ -20,6 +21,25 @@ func GetHashFromStr(str string) int {
 	return 0
 }
 
+// ToStringMap 将 yaml 解析出的 map[interface{}]interface{} 递归转换为可以 json 序列化的 map[string]interface{}
+func ToStringMap(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, v := range t {
+			m[fmt.Sprintf("%v", k)] = ToStringMap(v)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, v := range t {
+			l[i] = ToStringMap(v)
+		}
+		return l
+	}
+	return v
+}
+
 func IsDir(path string) bool {
 	s, err := os.Stat(path)
 	if err != nil {